@@ -0,0 +1,236 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// cacheManifest lists the files that were cached with a key
+type cacheManifest struct {
+	Key     string       `json:"key"`
+	Entries []cacheEntry `json:"entries"`
+}
+
+// cacheEntry is a cached file. Regular files are stored as objects named by the
+// SHA-256 of their content, so identical files are only stored once.
+type cacheEntry struct {
+	Path string      `json:"path"`
+	Mode os.FileMode `json:"mode"`
+	// Hash is the name of the object with the content of a regular file
+	Hash string `json:"hash,omitempty"`
+	// Link is the target of a symbolic link
+	Link string `json:"link,omitempty"`
+}
+
+// cacheStore is a local content-addressed cache for the paths of jobs
+type cacheStore struct {
+	dir string
+}
+
+// defaultCacheDir returns the cache directory of the user for gotopus. If it's
+// unknown, an empty string will be returned.
+func defaultCacheDir() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "gotopus")
+}
+
+func (c cacheStore) manifestPath(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return filepath.Join(c.dir, "manifests", hex.EncodeToString(sum[:])+".json")
+}
+
+func (c cacheStore) objectPath(hash string) string {
+	return filepath.Join(c.dir, "objects", hash[:2], hash)
+}
+
+// restore restores the files that were saved with key. If nothing was saved with
+// key, false will be returned.
+func (c cacheStore) restore(key string) (bool, error) {
+	data, err := ioutil.ReadFile(c.manifestPath(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	var manifest cacheManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return false, fmt.Errorf("invalid cache manifest of %s: %w", key, err)
+	}
+
+	for _, entry := range manifest.Entries {
+		if err := c.restoreEntry(entry); err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+func (c cacheStore) restoreEntry(entry cacheEntry) error {
+	if err := os.MkdirAll(filepath.Dir(entry.Path), 0755); err != nil {
+		return err
+	}
+
+	if entry.Link != "" {
+		if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return os.Symlink(entry.Link, entry.Path)
+	}
+
+	src, err := os.Open(c.objectPath(entry.Hash))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	// The file is written next to the destination, so that it can be renamed atomically
+	dst, err := ioutil.TempFile(filepath.Dir(entry.Path), ".gotopus-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Chmod(dst.Name(), entry.Mode.Perm()); err != nil {
+		return err
+	}
+	return os.Rename(dst.Name(), entry.Path)
+}
+
+// save stores every file that matches paths, and associates them with key
+func (c cacheStore) save(key string, paths []string) error {
+	files, err := expandGlobs(paths)
+	if err != nil {
+		return err
+	}
+
+	manifest := cacheManifest{Key: key}
+	for _, file := range files {
+		entry, err := c.saveFile(file)
+		if err != nil {
+			return err
+		}
+		manifest.Entries = append(manifest.Entries, entry)
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(c.manifestPath(key), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
+
+func (c cacheStore) saveFile(path string) (cacheEntry, error) {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+
+	entry := cacheEntry{Path: path, Mode: info.Mode()}
+	if info.Mode()&os.ModeSymlink != 0 {
+		entry.Link, err = os.Readlink(path)
+		return entry, err
+	}
+
+	entry.Hash, err = hashFile(path)
+	if err != nil {
+		return entry, err
+	}
+
+	object := c.objectPath(entry.Hash)
+	if _, err := os.Stat(object); err == nil {
+		return entry, nil
+	}
+
+	return entry, writeFileAtomic(object, func(w io.Writer) error {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		_, err = io.Copy(w, f)
+		return err
+	})
+}
+
+// writeFileAtomic creates the file at path with the content from write. Readers
+// either see the whole file or nothing.
+func writeFileAtomic(path string, write func(io.Writer) error) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// hashFile returns the SHA-256 of the content of the file at path
+func hashFile(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// hashFiles returns a SHA-256 of every file that matches patterns, or an empty
+// string when nothing matches
+func hashFiles(patterns []string) (string, error) {
+	files, err := expandGlobs(patterns)
+	if err != nil || len(files) == 0 {
+		return "", err
+	}
+
+	h := sha256.New()
+	for _, file := range files {
+		hash, err := hashFile(file)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(h, "%s %s\n", hash, file)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
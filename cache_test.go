@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestCacheStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := filepath.Join(dir, "files")
+	os.MkdirAll(filepath.Join(files, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(files, "a.txt"), []byte("same"), 0644)
+	ioutil.WriteFile(filepath.Join(files, "sub", "b.sh"), []byte("same"), 0755)
+	if err := os.Symlink("a.txt", filepath.Join(files, "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	store := cacheStore{dir: filepath.Join(dir, "cache")}
+	hit, err := store.restore("key")
+	if err != nil || hit {
+		t.Fatalf("expected a cache miss, but got %t, %v", hit, err)
+	}
+
+	if err := store.save("key", []string{files}); err != nil {
+		t.Fatal(err)
+	}
+
+	objects, _ := filepath.Glob(filepath.Join(store.dir, "objects", "*", "*"))
+	if len(objects) != 1 {
+		t.Fatalf("expected identical files to be stored once, but got %d objects", len(objects))
+	}
+
+	os.RemoveAll(files)
+	hit, err = store.restore("key")
+	if err != nil || !hit {
+		t.Fatalf("expected a cache hit, but got %t, %v", hit, err)
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(files, "sub", "b.sh"))
+	if err != nil || string(data) != "same" {
+		t.Fatalf("expected b.sh to be restored, but got \"%s\", %v", string(data), err)
+	}
+
+	info, err := os.Stat(filepath.Join(files, "sub", "b.sh"))
+	if err != nil || info.Mode().Perm() != 0755 {
+		t.Fatalf("expected b.sh to keep its mode, but got %v, %v", info.Mode(), err)
+	}
+
+	target, err := os.Readlink(filepath.Join(files, "link"))
+	if err != nil || target != "a.txt" {
+		t.Fatalf("expected the link to be restored, but got \"%s\", %v", target, err)
+	}
+}
+
+func TestHashFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lock := filepath.Join(dir, "go.sum")
+	ioutil.WriteFile(lock, []byte("v1"), 0644)
+	hash1, err := hashFiles([]string{lock})
+	if err != nil || hash1 == "" {
+		t.Fatalf("expected to get a hash, but got \"%s\", %v", hash1, err)
+	}
+
+	ioutil.WriteFile(lock, []byte("v2"), 0644)
+	hash2, err := hashFiles([]string{lock})
+	if err != nil || hash2 == hash1 {
+		t.Fatalf("expected the hash to change, but got \"%s\", %v", hash2, err)
+	}
+
+	empty, err := hashFiles([]string{filepath.Join(dir, "missing")})
+	if err != nil || empty != "" {
+		t.Fatalf("expected to get an empty hash, but got \"%s\", %v", empty, err)
+	}
+}
+
+func TestRunWithCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	lock := filepath.Join(dir, "deps.lock")
+	deps := filepath.Join(dir, "deps")
+	ioutil.WriteFile(lock, []byte("v1"), 0644)
+	cfg := Config{
+		Jobs: map[string]Job{
+			"install": {
+				Cache: Cache{Key: "deps-${{ hashFiles('" + lock + "') }}", Paths: []string{deps}},
+				Steps: []Step{{Run: `echo "hit=$GOTOPUS_CACHE_HIT" && mkdir -p ` + deps + ` && touch ` + deps + `/lib`}},
+			},
+		},
+	}
+
+	run := func() string {
+		var stdoutBuf syncBuffer
+		err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, CacheDir: filepath.Join(dir, "cache")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdoutBuf.String()
+	}
+
+	if out := run(); out != "hit=false\n" {
+		t.Fatalf("expected a cache miss, but got \"%s\"", out)
+	}
+
+	os.RemoveAll(deps)
+	if out := run(); !strings.HasPrefix(out, "restored the cache with key deps-") || !strings.HasSuffix(out, "hit=true\n") {
+		t.Fatalf("expected a cache hit, but got \"%s\"", out)
+	}
+
+	if _, err := os.Stat(filepath.Join(deps, "lib")); err != nil {
+		t.Fatal(err)
+	}
+
+	ioutil.WriteFile(lock, []byte("v2"), 0644)
+	if out := run(); out != "hit=false\n" {
+		t.Fatalf("expected a cache miss after the lock changed, but got \"%s\"", out)
+	}
+}
@@ -5,8 +5,7 @@ import (
 	"net/http"
 	"os"
 	"strings"
-
-	"gopkg.in/yaml.v2"
+	"time"
 )
 
 // Config represents a workflow that's going to be executed
@@ -16,8 +15,21 @@ import (
 type Config struct {
 	// Version is format version of the configuration
 	Version string `yaml:"version"`
-	// Jobs is used to build a dependency graph
+	// Jobs is used to build a dependency graph. NewConfig adds the jobs of the
+	// included configs with their namespaced IDs, e.g. lint/go
 	Jobs map[string]Job `yaml:"jobs"`
+	// Include lists the configs whose jobs are added to this config
+	Include []Include `yaml:"include"`
+	// Templates are the shapes of jobs that are only different in their parameters.
+	// Like jobs, the included templates are namespaced
+	Templates map[string]Template `yaml:"templates"`
+
+	// includePositions are the positions of Include in the config, when the config
+	// was decoded
+	includePositions []Position
+	// path is the canonical path of the config when it was loaded, or the canonical
+	// paths of the merged configs separated by NUL
+	path string
 }
 
 // Job is a collection of execution steps that run in sequential order.
@@ -28,6 +40,94 @@ type Job struct {
 	Needs []string `yaml:"needs"`
 	// Steps represent a list of commands that will be executed sequentially
 	Steps []Step `yaml:"steps"`
+	// Env is a user-space environment for every step of the job. The env of a
+	// step overrides it
+	Env map[string]string `yaml:"env"`
+	// Uses takes the name, env, steps, timeout, and retry from a template. The name,
+	// env, timeout, and retry of the job override the ones from the template
+	Uses string `yaml:"uses"`
+	// With are the arguments for the parameters of the template in Uses
+	With map[string]string `yaml:"with"`
+	// Timeout limits how long the whole job can run, e.g. 5m or 30s. If 0, the job can run forever
+	Timeout time.Duration `yaml:"timeout"`
+	// Retry re-runs the whole job when any of its steps fails
+	Retry Retry `yaml:"retry"`
+	// Strategy expands the job into multiple jobs
+	Strategy Strategy `yaml:"strategy"`
+	// If is an expression that decides whether the job runs once its dependencies
+	// have finished. If empty, the job only runs when all of its dependencies succeeded
+	If string `yaml:"if"`
+	// Inputs are file globs that the job reads. When a job has inputs, it's skipped
+	// as long as its definition and its inputs haven't changed since it last succeeded,
+	// and its outputs still exist
+	Inputs []string `yaml:"inputs"`
+	// Outputs are paths that the job creates
+	Outputs []string `yaml:"outputs"`
+	// Cache restores paths before the job runs, and saves them after it succeeds
+	Cache Cache `yaml:"cache"`
+	// Service keeps the last step running in the background. The job is done for its
+	// dependents once Readiness passes, and the last step is terminated after all of
+	// its dependents have finished
+	Service bool `yaml:"service"`
+	// Readiness tells when a service is ready. It's required for services
+	Readiness Readiness `yaml:"readiness"`
+
+	// position is where the job is defined, and usesPosition and needsPositions are
+	// the positions of Uses and Needs in the config, when the job was decoded from a config
+	position       Position
+	usesPosition   Position
+	needsPositions []Position
+}
+
+// Readiness is a probe that's repeated until it passes. Exactly one of TCP, HTTP,
+// or Exec has to be set.
+type Readiness struct {
+	// TCP passes when the address accepts connections, e.g. localhost:5432
+	TCP string `yaml:"tcp"`
+	// HTTP passes when a GET request to the URL responds with a 2xx or 3xx status
+	HTTP string `yaml:"http"`
+	// Exec passes when the shell command exits with 0
+	Exec string `yaml:"exec"`
+	// Interval is how long to wait between the probes. If 0, it'll be 1s
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is how long the service has to get ready. If 0, it'll be 1m
+	Timeout time.Duration `yaml:"timeout"`
+}
+
+// Cache describes what a job caches between runs
+type Cache struct {
+	// Key identifies the cached paths. It can contain ${{ expression }}, e.g.
+	// deps-${{ hashFiles('go.sum') }}. If empty, nothing will be cached
+	Key string `yaml:"key"`
+	// Paths are the file globs to cache
+	Paths []string `yaml:"paths"`
+}
+
+// Strategy describes how a job is expanded into multiple jobs
+type Strategy struct {
+	// Matrix runs a copy of the job for every combination of its values
+	Matrix Matrix `yaml:"matrix"`
+}
+
+// Matrix is a set of variables and their possible values. For example:
+//
+//	matrix:
+//	  go: [1.20, 1.21]
+//	  os: [linux, darwin]
+//	  exclude:
+//	    - go: 1.20
+//	      os: darwin
+//	  include:
+//	    - go: 1.21
+//	      os: windows
+type Matrix struct {
+	// Include adds values to the combinations that it matches, or adds a new
+	// combination when it doesn't match any
+	Include []map[string]string `yaml:"include"`
+	// Exclude removes the combinations that match all of its values
+	Exclude []map[string]string `yaml:"exclude"`
+	// Values maps a variable name to its possible values
+	Values map[string][]string `yaml:",inline"`
 }
 
 // Step represents what to execute
@@ -40,6 +140,24 @@ type Step struct {
 	// In case of conflicts, the priority order looks like the following:
 	//   system env -> builtin env -> user-space env
 	Env map[string]string `yaml:"env"`
+	// Timeout limits how long the step can run, e.g. 5m or 30s. If 0, the step can run forever
+	Timeout time.Duration `yaml:"timeout"`
+	// Retry re-runs the step when it fails
+	Retry Retry `yaml:"retry"`
+	// If is an expression that decides whether the step runs. If empty, the step
+	// only runs when all of the previous steps succeeded
+	If string `yaml:"if"`
+}
+
+// Retry is a policy to re-run something that failed
+type Retry struct {
+	// Attempts is the maximum number of runs, including the first one.
+	// If less than 2, there'll be no retries
+	Attempts int `yaml:"attempts"`
+	// Backoff is how long to wait before the next attempt
+	Backoff time.Duration `yaml:"backoff"`
+	// Multiplier grows Backoff after every attempt. If 0, Backoff stays the same
+	Multiplier float64 `yaml:"multiplier"`
 }
 
 func readerFromURL(path string) (io.ReadCloser, error) {
@@ -50,20 +168,23 @@ func readerFromURL(path string) (io.ReadCloser, error) {
 	return res.Body, nil
 }
 
-// NewConfig decodes from path. Path can be either an absolute/relative path
-// to a file or a url.
-func NewConfig(path string) (cfg Config, err error) {
-	var readCloser io.ReadCloser
-	if strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://") {
-		readCloser, err = readerFromURL(path)
-	} else {
-		readCloser, err = os.Open(path)
-	}
+// isURL returns true when path is a url rather than a path to a file
+func isURL(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
 
-	if err != nil {
-		return
+func openConfig(path string) (io.ReadCloser, error) {
+	if isURL(path) {
+		return readerFromURL(path)
 	}
-	defer readCloser.Close()
-	err = yaml.NewDecoder(readCloser).Decode(&cfg)
-	return
+	return os.Open(path)
+}
+
+// NewConfig decodes from path. Path can be either an absolute/relative path
+// to a file or a url. The config is decoded strictly along with the configs that
+// it includes, so every unknown key and invalid job is reported at once as a
+// *ValidationError.
+func NewConfig(path string) (Config, error) {
+	l := newConfigLoader()
+	return l.loadAll(path)
 }
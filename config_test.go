@@ -8,6 +8,7 @@ import (
 	"os"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestNewConfigFromFile(t *testing.T) {
@@ -98,6 +99,122 @@ jobs:
 	}
 }
 
+func TestNewConfigWithTimeouts(t *testing.T) {
+	configRaw := `
+jobs:
+  job_id:
+    timeout: 5m
+    steps:
+      - run: exit
+        timeout: 30s`
+
+	f, err := ioutil.TempFile("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	io.Copy(f, strings.NewReader(configRaw))
+
+	cfg, err := NewConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := cfg.Jobs["job_id"]
+	if job.Timeout != time.Minute*5 {
+		t.Fatalf("expected job timeout to be 5m, but got %s", job.Timeout)
+	}
+
+	if job.Steps[0].Timeout != time.Second*30 {
+		t.Fatalf("expected step timeout to be 30s, but got %s", job.Steps[0].Timeout)
+	}
+}
+
+func TestNewConfigWithMatrix(t *testing.T) {
+	configRaw := `
+jobs:
+  test:
+    strategy:
+      matrix:
+        go: [1.20, 1.21]
+        os: [linux]
+        exclude:
+          - go: 1.20
+        include:
+          - os: windows
+    steps:
+      - run: exit`
+
+	f, err := ioutil.TempFile("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	io.Copy(f, strings.NewReader(configRaw))
+
+	cfg, err := NewConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	matrix := cfg.Jobs["test"].Strategy.Matrix
+	if len(matrix.Values) != 2 || strings.Join(matrix.Values["go"], ",") != "1.20,1.21" {
+		t.Fatalf("expected the go values to be kept as strings, but got %v", matrix.Values)
+	}
+
+	if len(matrix.Exclude) != 1 || matrix.Exclude[0]["go"] != "1.20" {
+		t.Fatalf("expected to have 1 exclusion, but got %v", matrix.Exclude)
+	}
+
+	if len(matrix.Include) != 1 || matrix.Include[0]["os"] != "windows" {
+		t.Fatalf("expected to have 1 inclusion, but got %v", matrix.Include)
+	}
+}
+
+func TestNewConfigWithService(t *testing.T) {
+	configRaw := `
+jobs:
+  db:
+    service: true
+    readiness:
+      tcp: localhost:5432
+      interval: 500ms
+      timeout: 30s
+    steps:
+      - run: postgres`
+
+	f, err := ioutil.TempFile("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+	io.Copy(f, strings.NewReader(configRaw))
+
+	cfg, err := NewConfig(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job := cfg.Jobs["db"]
+	if !job.Service {
+		t.Fatal("expected db to be a service")
+	}
+
+	expected := Readiness{TCP: "localhost:5432", Interval: time.Millisecond * 500, Timeout: time.Second * 30}
+	if job.Readiness != expected {
+		t.Fatalf("expected the readiness to be %+v, but got %+v", expected, job.Readiness)
+	}
+}
+
 func TestNewConfigFromInvalidURL(t *testing.T) {
 	_, err := NewConfig("https://this-url-must-be-broken.test")
 	if err == nil {
@@ -2,6 +2,8 @@ package main
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 )
 
 // EnvBuiltinPrefix is a prefix that's used for registering builtin environments
@@ -26,7 +28,7 @@ func (e Env) SetBuiltin(key string, value interface{}) {
 	e.Set(EnvBuiltinPrefix+key, value)
 }
 
-// Encode encodes the keys and values to a list of "<key>=<value>"
+// Encode encodes the keys and values to a list of "<key>=<value>" sorted by keys
 func (e Env) Encode() []string {
 	encoded := make([]string, len(e))
 	var i int
@@ -34,5 +36,18 @@ func (e Env) Encode() []string {
 		encoded[i] = fmt.Sprintf("%s=%v", k, v)
 		i++
 	}
+	sort.Strings(encoded)
 	return encoded
 }
+
+// envMap converts a list of "<key>=<value>" like os.Environ() to a map. When a key
+// is repeated, the last value wins like it does for a command.
+func envMap(encoded []string) map[string]string {
+	env := make(map[string]string, len(encoded))
+	for _, kv := range encoded {
+		if i := strings.Index(kv, "="); i >= 0 {
+			env[kv[:i]] = kv[i+1:]
+		}
+	}
+	return env
+}
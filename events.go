@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Event types that are emitted during a run
+const (
+	EventRunStarted   = "run_started"
+	EventJobQueued    = "job_queued"
+	EventJobStarted   = "job_started"
+	EventStepStarted  = "step_started"
+	EventStepFinished = "step_finished"
+	EventJobFinished  = "job_finished"
+	EventRunFinished  = "run_finished"
+	// EventServiceStopped is emitted once a service has been torn down
+	EventServiceStopped = "service_stopped"
+)
+
+// Statuses of finished jobs and runs
+const (
+	StatusSuccess = "success"
+	StatusFailure = "failure"
+	StatusSkipped = "skipped"
+	// StatusUpToDate is only used by jobs that are skipped because their inputs haven't changed
+	StatusUpToDate = "up_to_date"
+	// StatusCompleted is only used by jobs that are skipped because they succeeded
+	// before the run was resumed
+	StatusCompleted = "completed"
+)
+
+// Event describes something that happened during a run. Fields that don't
+// apply to the event type are left empty.
+type Event struct {
+	// Type is one of the Event* constants
+	Type string `json:"type"`
+	// Time is when the event happened
+	Time time.Time `json:"time"`
+	// Job is the ID of the job
+	Job string `json:"job,omitempty"`
+	// Step is the position of the step within the job, starting from 1
+	Step int `json:"step,omitempty"`
+	// StepName is the name of the step
+	StepName string `json:"step_name,omitempty"`
+	// WorkerID is the ID of the worker that runs the job
+	WorkerID *uint64 `json:"worker_id,omitempty"`
+	// Attempt is the attempt number of the step or the job
+	Attempt int `json:"attempt,omitempty"`
+	// Status is one of the Status* constants
+	Status string `json:"status,omitempty"`
+	// ExitCode is the exit code of the step command. If the command couldn't
+	// start or was killed by a signal, it'll be -1.
+	ExitCode *int `json:"exit_code,omitempty"`
+	// DurationMS is how long the step, the job, or the run took in milliseconds
+	DurationMS *int64 `json:"duration_ms,omitempty"`
+	// Error is the error message when something failed
+	Error string `json:"error,omitempty"`
+	// Config is the name of the config when multiple configs run at the same time
+	Config string `json:"config,omitempty"`
+}
+
+// EventLog writes events as newline-delimited JSON. It's safe to emit events
+// from multiple goroutines. A nil *EventLog discards all events.
+type EventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+	// parent is the log that the events are written to with config, when the log
+	// was created by withConfig
+	parent *EventLog
+	config string
+}
+
+// NewEventLog creates an EventLog that writes to w
+func NewEventLog(w io.Writer) *EventLog {
+	return &EventLog{enc: json.NewEncoder(w)}
+}
+
+// openEventLog creates an EventLog that writes to a file at path. If path is "-",
+// the events will be written to stdout. The returned function closes the file.
+func openEventLog(path string) (*EventLog, func() error, error) {
+	if path == "-" {
+		return NewEventLog(os.Stdout), func() error { return nil }, nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return NewEventLog(f), f.Close, nil
+}
+
+// withConfig returns a log that writes the events to l with their Config set to config
+func (l *EventLog) withConfig(config string) *EventLog {
+	if l == nil {
+		return nil
+	}
+	return &EventLog{parent: l, config: config}
+}
+
+// Emit writes e to the log. If e.Time is not set, the current time will be used.
+// Failing to write an event doesn't interrupt the run, so the error is ignored.
+func (l *EventLog) Emit(e Event) {
+	if l == nil {
+		return
+	}
+
+	if l.parent != nil {
+		e.Config = l.config
+		l.parent.Emit(e)
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.enc.Encode(e)
+}
+
+// durationMS converts d to a value for Event.DurationMS
+func durationMS(d time.Duration) *int64 {
+	ms := int64(d / time.Millisecond)
+	return &ms
+}
+
+// errorMessage converts err to a value for Event.Error
+func errorMessage(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
+
+// statusOf converts err to a value for Event.Status
+func statusOf(err error) string {
+	if err == nil {
+		return StatusSuccess
+	}
+	return StatusFailure
+}
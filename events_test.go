@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func decodeEvents(t *testing.T, buf *bytes.Buffer) []Event {
+	var events []Event
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var e Event
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			t.Fatalf("expected every line to be a JSON event, but got \"%s\": %v", scanner.Text(), err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func TestEventLogNil(t *testing.T) {
+	var events *EventLog
+	events.Emit(Event{Type: EventRunStarted})
+}
+
+func TestEventLogEmit(t *testing.T) {
+	var buf bytes.Buffer
+	events := NewEventLog(&buf)
+	code := 1
+	events.Emit(Event{Type: EventStepFinished, Job: "job1", Step: 1, ExitCode: &code})
+
+	decoded := decodeEvents(t, &buf)
+	if len(decoded) != 1 {
+		t.Fatalf("expected to get 1 event, but got %d", len(decoded))
+	}
+
+	e := decoded[0]
+	if e.Type != EventStepFinished || e.Job != "job1" || e.Step != 1 || *e.ExitCode != 1 {
+		t.Fatalf("expected to get the emitted event back, but got %+v", e)
+	}
+
+	if e.Time.IsZero() {
+		t.Fatal("expected the event time to be set")
+	}
+}
+
+func TestRunEmitsEvents(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{{Name: "ok", Run: "echo ok"}, {Name: "fail", Run: "exit 3"}}},
+			"job2": {Needs: []string{"job1"}},
+		},
+	}
+
+	var stdoutBuf, eventsBuf bytes.Buffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, KeepGoing: true, Events: NewEventLog(&eventsBuf)})
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	events := decodeEvents(t, &eventsBuf)
+	var types []string
+	for _, e := range events {
+		types = append(types, e.Type)
+	}
+
+	expected := []string{
+		EventRunStarted,
+		EventJobQueued,
+		EventJobStarted,
+		EventStepStarted,
+		EventStepFinished,
+		EventStepStarted,
+		EventStepFinished,
+		EventJobFinished,
+		EventJobFinished,
+		EventRunFinished,
+	}
+	if strings.Join(types, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected the events to be %v, but got %v", expected, types)
+	}
+
+	failedStep := events[6]
+	if failedStep.StepName != "fail" || failedStep.Step != 2 || *failedStep.ExitCode != 3 || failedStep.Status != StatusFailure {
+		t.Fatalf("expected the second step to fail with exit code 3, but got %+v", failedStep)
+	}
+
+	if failedStep.WorkerID == nil || failedStep.DurationMS == nil {
+		t.Fatalf("expected the step event to have a worker ID and a duration, but got %+v", failedStep)
+	}
+
+	skippedJob := events[8]
+	if skippedJob.Job != "job2" || skippedJob.Status != StatusSkipped {
+		t.Fatalf("expected job2 to be skipped, but got %+v", skippedJob)
+	}
+
+	if runFinished := events[9]; runFinished.Status != StatusFailure || runFinished.Error == "" {
+		t.Fatalf("expected the run to fail, but got %+v", runFinished)
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+const (
+	// GraphFormatDOT is the Graphviz DOT language
+	GraphFormatDOT = "dot"
+	// GraphFormatMermaid is the Mermaid flowchart syntax
+	GraphFormatMermaid = "mermaid"
+)
+
+// nodeLabel returns the job name of n, or its ID if the job doesn't have a name
+func nodeLabel(n *Node) string {
+	if n.Job.Name != "" {
+		return n.Job.Name
+	}
+	return n.ID
+}
+
+// WriteGraph writes the dependency graph from root to w in format. Every job
+// becomes a node labeled with its name, and every dependency becomes an edge
+// from the dependency to its dependent. The output is sorted by job IDs, so
+// the same graph always produces the same output.
+func WriteGraph(w io.Writer, root *Node, format string) error {
+	switch format {
+	case GraphFormatDOT:
+		return writeDOT(w, root)
+	case GraphFormatMermaid:
+		return writeMermaid(w, root)
+	}
+	return fmt.Errorf("unknown graph format: %s", format)
+}
+
+func writeDOT(w io.Writer, root *Node) error {
+	quote := strings.NewReplacer(`\`, `\\`, `"`, `\"`)
+	nodes := root.Descendants()
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "digraph gotopus {")
+	for _, node := range nodes {
+		fmt.Fprintf(bw, "  \"%s\" [label=\"%s\"];\n", quote.Replace(node.ID), quote.Replace(nodeLabel(node)))
+	}
+
+	for _, node := range nodes {
+		for _, dependent := range sortedNodes(node.Dependents) {
+			fmt.Fprintf(bw, "  \"%s\" -> \"%s\";\n", quote.Replace(node.ID), quote.Replace(dependent.ID))
+		}
+	}
+	fmt.Fprintln(bw, "}")
+	return bw.Flush()
+}
+
+func writeMermaid(w io.Writer, root *Node) error {
+	// Mermaid is picky about node IDs, so the nodes get generated IDs instead
+	quote := strings.NewReplacer(`"`, "#quot;")
+	nodes := root.Descendants()
+	ids := make(map[*Node]string, len(nodes))
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "graph TD")
+	for i, node := range nodes {
+		ids[node] = fmt.Sprintf("n%d", i)
+		fmt.Fprintf(bw, "  %s[\"%s\"]\n", ids[node], quote.Replace(nodeLabel(node)))
+	}
+
+	for _, node := range nodes {
+		for _, dependent := range sortedNodes(node.Dependents) {
+			fmt.Fprintf(bw, "  %s --> %s\n", ids[node], ids[dependent])
+		}
+	}
+	return bw.Flush()
+}
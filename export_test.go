@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func newExportTestGraph(t *testing.T) *Node {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {Name: `Build "app"`},
+			"lint":  {},
+			"test":  {Name: "Test", Needs: []string{"build", "lint"}},
+		},
+	}
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return graph
+}
+
+func TestWriteGraphDOT(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteGraph(&buf, newExportTestGraph(t), GraphFormatDOT)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `digraph gotopus {
+  "build" [label="Build \"app\""];
+  "lint" [label="lint"];
+  "test" [label="Test"];
+  "build" -> "test";
+  "lint" -> "test";
+}
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("expected the graph to be\n%s\nbut got\n%s", expected, actual)
+	}
+}
+
+func TestWriteGraphMermaid(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteGraph(&buf, newExportTestGraph(t), GraphFormatMermaid)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `graph TD
+  n0["Build #quot;app#quot;"]
+  n1["lint"]
+  n2["Test"]
+  n0 --> n2
+  n1 --> n2
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("expected the graph to be\n%s\nbut got\n%s", expected, actual)
+	}
+}
+
+func TestWriteGraphUnknownFormat(t *testing.T) {
+	var buf bytes.Buffer
+	err := WriteGraph(&buf, newExportTestGraph(t), "png")
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+}
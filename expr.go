@@ -0,0 +1,769 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Expr is a parsed expression from an "if" field. Following is the syntax:
+//   - literals: 'string' (a quote is escaped by doubling it), 42, 1.5, true, false, null
+//   - contexts: env.NAME, matrix.NAME, needs.JOB.result, needs.JOB.outputs.KEY, and
+//     params.NAME in templates. A property can also be accessed by index, e.g. needs['build-app']
+//   - operators: ( ), !, <, <=, >, >=, ==, !=, &&, ||
+//   - status functions: success(), failure(), cancelled(), always()
+//   - string functions: contains(s, sub), startsWith(s, prefix), endsWith(s, suffix)
+//   - hashFiles(glob, ...): a SHA-256 of the files that match the globs, or an empty string when
+//     there are none
+//
+// An expression can optionally be wrapped in ${{ }}. When an expression doesn't call
+// any of the status functions, success() && is implied, like in GitHub Actions.
+type Expr struct {
+	root       exprNode
+	usesStatus bool
+}
+
+// ExprContext contains the values that an expression can refer to
+type ExprContext struct {
+	// Env contains the environment variables for env.NAME
+	Env map[string]string
+	// Matrix contains the matrix values for matrix.NAME
+	Matrix map[string]string
+	// Needs contains the dependencies by their IDs for needs.JOB
+	Needs map[string]NeedContext
+	// Params contains the typed template parameters for params.NAME
+	Params map[string]interface{}
+	// Success is the result of success()
+	Success bool
+	// Failure is the result of failure()
+	Failure bool
+	// Cancelled is the result of cancelled()
+	Cancelled bool
+}
+
+// NeedContext describes a finished dependency
+type NeedContext struct {
+	// Result is one of StatusSuccess, StatusFailure, or StatusSkipped
+	Result string
+	// Outputs are the outputs of the dependency
+	Outputs map[string]string
+}
+
+// exprContextNames are the names that an expression can start a property access from
+var exprContextNames = map[string]struct{}{"env": {}, "matrix": {}, "needs": {}, "params": {}}
+
+// exprFunctions maps the available functions to the number of their arguments.
+// -1 means at least one argument.
+var exprFunctions = map[string]int{
+	"success":    0,
+	"failure":    0,
+	"cancelled":  0,
+	"always":     0,
+	"contains":   2,
+	"startsWith": 2,
+	"endsWith":   2,
+	"hashFiles":  -1,
+}
+
+// exprStatusFunctions are the functions that disable the implied success()
+var exprStatusFunctions = map[string]struct{}{"success": {}, "failure": {}, "cancelled": {}, "always": {}}
+
+// ParseExpr parses s into an expression
+func ParseExpr(s string) (*Expr, error) {
+	trimmed := strings.TrimSpace(s)
+	if strings.HasPrefix(trimmed, "${{") && strings.HasSuffix(trimmed, "}}") {
+		trimmed = trimmed[3 : len(trimmed)-2]
+	}
+
+	tokens, err := lexExpr(trimmed)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", s, err)
+	}
+
+	p := exprParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err == nil && p.peek().kind != tokenEOF {
+		err = fmt.Errorf("unexpected %s", p.peek())
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid expression %q: %w", s, err)
+	}
+	return &Expr{root: root, usesStatus: p.usesStatus}, nil
+}
+
+// Eval evaluates e with ctx, and converts the result to a boolean
+func (e *Expr) Eval(ctx ExprContext) (bool, error) {
+	value, err := e.root.eval(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	if !e.usesStatus && !ctx.Success {
+		return false, nil
+	}
+	return truthy(value), nil
+}
+
+// Value evaluates e with ctx without converting the result
+func (e *Expr) Value(ctx ExprContext) (interface{}, error) {
+	return e.root.eval(ctx)
+}
+
+// interpolate replaces every ${{ expression }} in s with its value
+func interpolate(s string, ctx ExprContext) (string, error) {
+	var sb strings.Builder
+	err := scanInterpolation(s, func(text string, expr *Expr) error {
+		sb.WriteString(text)
+		if expr == nil {
+			return nil
+		}
+
+		value, err := expr.Value(ctx)
+		if err != nil {
+			return err
+		}
+		sb.WriteString(toString(value))
+		return nil
+	})
+	return sb.String(), err
+}
+
+// validateInterpolation parses every ${{ expression }} in s without evaluating them
+func validateInterpolation(s string) error {
+	return scanInterpolation(s, func(string, *Expr) error { return nil })
+}
+
+// scanInterpolation parses s, and calls fn with the text before every ${{ expression }}
+// and the expression. The text after the last expression is passed with a nil expression.
+func scanInterpolation(s string, fn func(text string, expr *Expr) error) error {
+	for {
+		start := strings.Index(s, "${{")
+		if start < 0 {
+			return fn(s, nil)
+		}
+
+		end := strings.Index(s[start:], "}}")
+		if end < 0 {
+			return fmt.Errorf("missing }} in %q", s)
+		}
+		end += start + 2
+
+		expr, err := ParseExpr(s[start:end])
+		if err != nil {
+			return err
+		}
+
+		if err := fn(s[:start], expr); err != nil {
+			return err
+		}
+		s = s[end:]
+	}
+}
+
+// contextRefs returns the contexts that e refers to, e.g. params for params.dir,
+// along with the properties that are accessed by a literal, e.g. dir
+func (e *Expr) contextRefs() map[string][]string {
+	refs := make(map[string][]string)
+	var walk func(node exprNode)
+	walk = func(node exprNode) {
+		switch n := node.(type) {
+		case *contextNode:
+			if _, ok := refs[n.name]; !ok {
+				refs[n.name] = nil
+			}
+		case *indexNode:
+			if target, ok := n.target.(*contextNode); ok {
+				if index, ok := n.index.(*literalNode); ok {
+					refs[target.name] = append(refs[target.name], toString(index.value))
+				}
+			}
+			walk(n.target)
+			walk(n.index)
+		case *notNode:
+			walk(n.operand)
+		case *logicalNode:
+			walk(n.left)
+			walk(n.right)
+		case *compareNode:
+			walk(n.left)
+			walk(n.right)
+		case *callNode:
+			for _, arg := range n.args {
+				walk(arg)
+			}
+		}
+	}
+	walk(e.root)
+	return refs
+}
+
+// evalCondition evaluates condition with ctx. An empty condition means success().
+func evalCondition(condition string, ctx ExprContext) (bool, error) {
+	if condition == "" {
+		return ctx.Success, nil
+	}
+
+	expr, err := ParseExpr(condition)
+	if err != nil {
+		return false, err
+	}
+	return expr.Eval(ctx)
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenIdent
+	tokenString
+	tokenNumber
+	tokenPunct
+)
+
+type exprToken struct {
+	kind  tokenKind
+	value string
+}
+
+func (t exprToken) String() string {
+	switch t.kind {
+	case tokenEOF:
+		return "end of expression"
+	case tokenString:
+		return fmt.Sprintf("string '%s'", t.value)
+	default:
+		return fmt.Sprintf("%q", t.value)
+	}
+}
+
+// exprPuncts are the operators and punctuation, longest first
+var exprPuncts = []string{"==", "!=", "<=", ">=", "&&", "||", "<", ">", "!", "(", ")", "[", "]", ",", "."}
+
+func lexExpr(s string) ([]exprToken, error) {
+	var tokens []exprToken
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '\'':
+			var sb strings.Builder
+			i++
+			for {
+				if i >= len(runes) {
+					return nil, fmt.Errorf("unterminated string")
+				}
+
+				if runes[i] == '\'' {
+					if i+1 < len(runes) && runes[i+1] == '\'' {
+						sb.WriteRune('\'')
+						i += 2
+						continue
+					}
+					i++
+					break
+				}
+				sb.WriteRune(runes[i])
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenString, value: sb.String()})
+		case unicode.IsDigit(r):
+			start := i
+			for i < len(runes) && (unicode.IsDigit(runes[i]) || runes[i] == '.') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenNumber, value: string(runes[start:i])})
+		case unicode.IsLetter(r) || r == '_':
+			start := i
+			for i < len(runes) && (unicode.IsLetter(runes[i]) || unicode.IsDigit(runes[i]) || runes[i] == '_' || runes[i] == '-') {
+				i++
+			}
+			tokens = append(tokens, exprToken{kind: tokenIdent, value: string(runes[start:i])})
+		default:
+			var matched bool
+			for _, punct := range exprPuncts {
+				if strings.HasPrefix(string(runes[i:]), punct) {
+					tokens = append(tokens, exprToken{kind: tokenPunct, value: punct})
+					i += len([]rune(punct))
+					matched = true
+					break
+				}
+			}
+
+			if !matched {
+				return nil, fmt.Errorf("unexpected character %q", r)
+			}
+		}
+	}
+	return append(tokens, exprToken{kind: tokenEOF}), nil
+}
+
+type exprParser struct {
+	tokens     []exprToken
+	pos        int
+	usesStatus bool
+}
+
+func (p *exprParser) peek() exprToken {
+	return p.tokens[p.pos]
+}
+
+func (p *exprParser) next() exprToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token if it's the punctuation punct
+func (p *exprParser) accept(punct string) bool {
+	if t := p.peek(); t.kind == tokenPunct && t.value == punct {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *exprParser) expect(punct string) error {
+	if !p.accept(punct) {
+		return fmt.Errorf("expected %q, but got %s", punct, p.peek())
+	}
+	return nil
+}
+
+func (p *exprParser) parseOr() (exprNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("||") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseAnd() (exprNode, error) {
+	left, err := p.parseComparison()
+	if err != nil {
+		return nil, err
+	}
+
+	for p.accept("&&") {
+		right, err := p.parseComparison()
+		if err != nil {
+			return nil, err
+		}
+		left = &logicalNode{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *exprParser) parseComparison() (exprNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+
+	for {
+		t := p.peek()
+		if t.kind != tokenPunct {
+			return left, nil
+		}
+
+		switch t.value {
+		case "==", "!=", "<", "<=", ">", ">=":
+		default:
+			return left, nil
+		}
+
+		p.next()
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = &compareNode{op: t.value, left: left, right: right}
+	}
+}
+
+func (p *exprParser) parseUnary() (exprNode, error) {
+	if p.accept("!") {
+		operand, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return &notNode{operand: operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *exprParser) parsePrimary() (exprNode, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenString:
+		return &literalNode{value: t.value}, nil
+	case tokenNumber:
+		n, err := strconv.ParseFloat(t.value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %s", t.value)
+		}
+		return &literalNode{value: n}, nil
+	case tokenPunct:
+		if t.value != "(" {
+			return nil, fmt.Errorf("unexpected %s", t)
+		}
+
+		inner, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return inner, p.expect(")")
+	case tokenIdent:
+		switch t.value {
+		case "true":
+			return &literalNode{value: true}, nil
+		case "false":
+			return &literalNode{value: false}, nil
+		case "null":
+			return &literalNode{value: nil}, nil
+		}
+
+		if p.accept("(") {
+			return p.parseCall(t.value)
+		}
+		return p.parseProperty(t.value)
+	default:
+		return nil, fmt.Errorf("unexpected %s", t)
+	}
+}
+
+func (p *exprParser) parseCall(name string) (exprNode, error) {
+	arity, ok := exprFunctions[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown function %s", name)
+	}
+
+	if _, ok := exprStatusFunctions[name]; ok {
+		p.usesStatus = true
+	}
+
+	var args []exprNode
+	if !p.accept(")") {
+		for {
+			arg, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+			args = append(args, arg)
+
+			if p.accept(")") {
+				break
+			}
+
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if arity < 0 && len(args) == 0 {
+		return nil, fmt.Errorf("%s expects at least 1 argument", name)
+	}
+
+	if arity >= 0 && len(args) != arity {
+		return nil, fmt.Errorf("%s expects %d argument(s), but got %d", name, arity, len(args))
+	}
+	return &callNode{name: name, args: args}, nil
+}
+
+func (p *exprParser) parseProperty(name string) (exprNode, error) {
+	if _, ok := exprContextNames[name]; !ok {
+		return nil, fmt.Errorf("unknown name %s", name)
+	}
+
+	var node exprNode = &contextNode{name: name}
+	for {
+		switch {
+		case p.accept("."):
+			t := p.next()
+			if t.kind != tokenIdent {
+				return nil, fmt.Errorf("expected a property name, but got %s", t)
+			}
+			node = &indexNode{target: node, index: &literalNode{value: t.value}}
+		case p.accept("["):
+			index, err := p.parseOr()
+			if err != nil {
+				return nil, err
+			}
+
+			if err := p.expect("]"); err != nil {
+				return nil, err
+			}
+			node = &indexNode{target: node, index: index}
+		default:
+			return node, nil
+		}
+	}
+}
+
+// exprNode is a node of a parsed expression. The values are nil, bool, float64,
+// string, or map[string]interface{}.
+type exprNode interface {
+	eval(ctx ExprContext) (interface{}, error)
+}
+
+type literalNode struct {
+	value interface{}
+}
+
+func (n *literalNode) eval(ctx ExprContext) (interface{}, error) {
+	return n.value, nil
+}
+
+type contextNode struct {
+	name string
+}
+
+func (n *contextNode) eval(ctx ExprContext) (interface{}, error) {
+	switch n.name {
+	case "env":
+		return stringsToValues(ctx.Env), nil
+	case "matrix":
+		return stringsToValues(ctx.Matrix), nil
+	case "needs":
+		needs := make(map[string]interface{}, len(ctx.Needs))
+		for id, need := range ctx.Needs {
+			needs[id] = map[string]interface{}{
+				"result":  need.Result,
+				"outputs": stringsToValues(need.Outputs),
+			}
+		}
+		return needs, nil
+	case "params":
+		params := make(map[string]interface{}, len(ctx.Params))
+		for k, v := range ctx.Params {
+			params[k] = v
+		}
+		return params, nil
+	}
+	return nil, fmt.Errorf("unknown name %s", n.name)
+}
+
+func stringsToValues(m map[string]string) map[string]interface{} {
+	values := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		values[k] = v
+	}
+	return values
+}
+
+type indexNode struct {
+	target exprNode
+	index  exprNode
+}
+
+func (n *indexNode) eval(ctx ExprContext) (interface{}, error) {
+	target, err := n.target.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	index, err := n.index.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Like GitHub Actions, accessing a missing property results in null
+	m, ok := target.(map[string]interface{})
+	if !ok {
+		return nil, nil
+	}
+	return m[toString(index)], nil
+}
+
+type notNode struct {
+	operand exprNode
+}
+
+func (n *notNode) eval(ctx ExprContext) (interface{}, error) {
+	value, err := n.operand.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return !truthy(value), nil
+}
+
+type logicalNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (n *logicalNode) eval(ctx ExprContext) (interface{}, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if (n.op == "&&") != truthy(left) {
+		return left, nil
+	}
+	return n.right.eval(ctx)
+}
+
+type compareNode struct {
+	op    string
+	left  exprNode
+	right exprNode
+}
+
+func (n *compareNode) eval(ctx ExprContext) (interface{}, error) {
+	left, err := n.left.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	right, err := n.right.eval(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cmp int
+	leftStr, leftIsStr := left.(string)
+	rightStr, rightIsStr := right.(string)
+	if leftIsStr && rightIsStr {
+		cmp = strings.Compare(leftStr, rightStr)
+	} else {
+		// Values of different types are compared as numbers, like in GitHub Actions
+		l, r := toNumber(left), toNumber(right)
+		if math.IsNaN(l) || math.IsNaN(r) {
+			return n.op == "!=", nil
+		}
+
+		switch {
+		case l < r:
+			cmp = -1
+		case l > r:
+			cmp = 1
+		}
+	}
+
+	switch n.op {
+	case "==":
+		return cmp == 0, nil
+	case "!=":
+		return cmp != 0, nil
+	case "<":
+		return cmp < 0, nil
+	case "<=":
+		return cmp <= 0, nil
+	case ">":
+		return cmp > 0, nil
+	default:
+		return cmp >= 0, nil
+	}
+}
+
+type callNode struct {
+	name string
+	args []exprNode
+}
+
+func (n *callNode) eval(ctx ExprContext) (interface{}, error) {
+	args := make([]string, len(n.args))
+	for i, arg := range n.args {
+		value, err := arg.eval(ctx)
+		if err != nil {
+			return nil, err
+		}
+		args[i] = toString(value)
+	}
+
+	switch n.name {
+	case "success":
+		return ctx.Success, nil
+	case "failure":
+		return ctx.Failure, nil
+	case "cancelled":
+		return ctx.Cancelled, nil
+	case "always":
+		return true, nil
+	case "contains":
+		return strings.Contains(args[0], args[1]), nil
+	case "startsWith":
+		return strings.HasPrefix(args[0], args[1]), nil
+	case "endsWith":
+		return strings.HasSuffix(args[0], args[1]), nil
+	case "hashFiles":
+		return hashFiles(args)
+	}
+	return nil, fmt.Errorf("unknown function %s", n.name)
+}
+
+// truthy converts value to a boolean. null, false, 0, NaN, and empty strings are false.
+func truthy(value interface{}) bool {
+	switch v := value.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case float64:
+		return v != 0 && !math.IsNaN(v)
+	case string:
+		return v != ""
+	default:
+		return true
+	}
+}
+
+// toNumber converts value to a number. Values that can't be converted become NaN.
+func toNumber(value interface{}) float64 {
+	switch v := value.(type) {
+	case nil:
+		return 0
+	case bool:
+		if v {
+			return 1
+		}
+		return 0
+	case float64:
+		return v
+	case string:
+		if strings.TrimSpace(v) == "" {
+			return 0
+		}
+
+		n, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil {
+			return math.NaN()
+		}
+		return n
+	default:
+		return math.NaN()
+	}
+}
+
+// toString converts value to a string for the string functions
+func toString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return strconv.FormatBool(v)
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	case string:
+		return v
+	default:
+		return ""
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestExprEval(t *testing.T) {
+	ctx := ExprContext{
+		Env:    map[string]string{"BRANCH": "main", "COUNT": "3"},
+		Matrix: map[string]string{"os": "linux"},
+		Needs: map[string]NeedContext{
+			"build-app": {Result: StatusSuccess, Outputs: map[string]string{"version": "1.2.3"}},
+		},
+		Params:  map[string]interface{}{"race": true, "shards": 4.0},
+		Success: true,
+	}
+
+	tests := []struct {
+		expr     string
+		expected bool
+	}{
+		{"env.BRANCH == 'main'", true},
+		{"${{ env.BRANCH != 'main' }}", false},
+		{"env.MISSING", false},
+		{"env.MISSING == ''", true},
+		{"env.COUNT > 2 && env.COUNT <= 3", true},
+		{"env.COUNT == 3.0", true},
+		{"!(env.BRANCH == 'dev') || false", true},
+		{"matrix.os == 'linux'", true},
+		{"needs.build-app.result == 'success'", true},
+		{"needs['build-app'].outputs.version == '1.2.3'", true},
+		{"startsWith(needs.build-app.outputs.version, '1.')", true},
+		{"params.race && params.shards > 3", true},
+		{"endsWith('gotopus', 'pus') && contains('gotopus', 'top')", true},
+		{"'it''s' == 'it''s'", true},
+		{"'a' < 'b'", true},
+		{"'abc' == 1", false},
+		{"null == 0 && true != false", true},
+		{"success()", true},
+		{"failure()", false},
+		{"always()", true},
+		{"cancelled()", false},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseExpr(test.expr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := expr.Eval(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != test.expected {
+			t.Fatalf("expected %s to be %t, but got %t", test.expr, test.expected, actual)
+		}
+	}
+}
+
+func TestExprEvalImpliedSuccess(t *testing.T) {
+	ctx := ExprContext{Env: map[string]string{"BRANCH": "main"}, Failure: true}
+
+	expr, err := ParseExpr("env.BRANCH == 'main'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run, err := expr.Eval(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if run {
+		t.Fatal("expected success() to be implied when no status function is called")
+	}
+
+	expr, err = ParseExpr("failure() && env.BRANCH == 'main'")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	run, err = expr.Eval(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !run {
+		t.Fatal("expected the expression to be true after a failure")
+	}
+}
+
+func TestParseExprInvalid(t *testing.T) {
+	invalid := []string{
+		"",
+		"env.BRANCH ==",
+		"'unterminated",
+		"unknown.value",
+		"unknown()",
+		"success(1)",
+		"contains('a')",
+		"(success()",
+		"env.BRANCH = 'main'",
+		"success() success()",
+	}
+
+	for _, s := range invalid {
+		if _, err := ParseExpr(s); err == nil {
+			t.Fatalf("expected %q to be invalid", s)
+		}
+	}
+}
+
+func TestEvalConditionEmpty(t *testing.T) {
+	run, err := evalCondition("", ExprContext{Success: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !run {
+		t.Fatal("expected an empty condition to mean success()")
+	}
+}
+
+func TestInterpolate(t *testing.T) {
+	ctx := ExprContext{Env: map[string]string{"OS": "linux"}, Matrix: map[string]string{"go": "1.20"}}
+	actual, err := interpolate("deps-${{ env.OS }}-${{matrix.go}}-${{ 1 == 1 }}", ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual != "deps-linux-1.20-true" {
+		t.Fatalf("expected \"deps-linux-1.20-true\", but got \"%s\"", actual)
+	}
+
+	if _, err := interpolate("deps-${{ env.OS", ctx); err == nil {
+		t.Fatal("expected to get an error due to a missing }}")
+	}
+}
+
+func TestExprContextRefs(t *testing.T) {
+	expr, err := ParseExpr("params.dir == 'api' && contains(env.PATH, params['bin']) || !matrix[params.os]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	refs := expr.contextRefs()
+	expected := map[string][]string{"params": {"dir", "bin", "os"}, "env": {"PATH"}, "matrix": nil}
+	if !reflect.DeepEqual(refs, expected) {
+		t.Fatalf("expected the references to be %v, but got %v", expected, refs)
+	}
+}
@@ -1,44 +1,412 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
+// defaultGracePeriod is how long a job has to exit after being interrupted
+// before it gets killed
+const defaultGracePeriod = time.Second * 10
+
+// defaultStateDir is where gotopus keeps its state between runs
+const defaultStateDir = ".gotopus"
+
+// stringsFlag is a flag that can be repeated to collect multiple values
+type stringsFlag []string
+
+func (f *stringsFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringsFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// interruptedExitCode is the exit code when the jobs are killed by a second interrupt
+const interruptedExitCode = 130
+
+// exit is how the program exits when it's interrupted twice
+var exit = os.Exit
+
+// notifyInterrupt returns a context that gets cancelled when SIGINT or SIGTERM
+// is received. When another signal is received while the jobs are terminating,
+// every running job is killed with SIGKILL, and the program exits right away.
+// The returned function must be called to release the resources.
+func notifyInterrupt() (context.Context, func()) {
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-stopped:
+			return
+		}
+
+		select {
+		case <-signals:
+			killRunningCmds()
+			exit(interruptedExitCode)
+		case <-stopped:
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(signals)
+		close(stopped)
+		cancel()
+	}
+}
+
+// Start parses args and runs the command from args. The returned value is the exit code.
+// Following are available commands:
+//   - gotopus <url or filepath> ...
+//   - gotopus run [-mode sequential|concurrent|merged] [-resumable | -resume <run id>] <url or filepath> ...
+//   - gotopus watch <url or filepath>
+//   - gotopus graph <url or filepath>
+//   - gotopus validate <url or filepath> ...
 func Start(programName string, args ...string) int {
+	if len(args) > 0 && args[0] == "graph" {
+		return startGraph(programName+" graph", args[1:]...)
+	}
+
+	if len(args) > 0 && args[0] == "validate" {
+		return startValidate(programName+" validate", args[1:]...)
+	}
+
+	if len(args) > 0 && args[0] == "watch" {
+		return startWatch(programName+" watch", args[1:]...)
+	}
+
+	if len(args) > 0 && args[0] == "run" {
+		return startRun(programName, args[1:]...)
+	}
+	return startRun(programName, args...)
+}
+
+// addRunFlags adds the flags that tweak how the jobs are run to flagSet
+func addRunFlags(flagSet *flag.FlagSet, opts *RunOptions) {
+	flagSet.Uint64Var(&opts.MaxWorkers, "max_workers", 0, "limits the number of workers that can run concurrently (default 0 or limitless)")
+	flagSet.BoolVar(&opts.KeepGoing, "keep_going", false, "keeps running jobs that don't depend on a failed job")
+	flagSet.StringVar(&opts.Output, "output", OutputStream, "how the output from concurrent jobs is shown: stream, prefixed, or grouped")
+	flagSet.BoolVar(&opts.PrefixStep, "prefix_step", false, "adds the step name to the line prefix in the prefixed output")
+	flagSet.BoolVar(&opts.Color, "color", false, "colors the line prefix of every job in the prefixed output")
+	flagSet.DurationVar(&opts.GracePeriod, "grace_period", defaultGracePeriod, "how long interrupted jobs have to exit before they get killed")
+	flagSet.StringVar(&opts.CacheDir, "cache_dir", defaultCacheDir(), "where the paths from the caches of the jobs are stored")
+	flagSet.StringVar(&opts.StateDir, "state_dir", defaultStateDir, "where the progress of resumable runs and the hashes of the jobs with inputs are kept between runs")
+}
+
+// startRun runs the jobs from the configs in args
+func startRun(programName string, args ...string) int {
 	flagSet := flag.NewFlagSet(programName, flag.ExitOnError)
 	flagSet.Usage = func() {
-		fmt.Fprintf(flagSet.Output(), "Usage: %s <url or filepath> ...\n\n", programName)
+		fmt.Fprintf(flagSet.Output(), "Usage: %s <url or filepath> ...\n", programName)
+		fmt.Fprintf(flagSet.Output(), "       %s run [-mode sequential|concurrent|merged] [-resumable | -resume <run id>] [<url or filepath> ...]\n", programName)
+		fmt.Fprintf(flagSet.Output(), "       %s watch [-debounce <duration>] <url or filepath>\n", programName)
+		fmt.Fprintf(flagSet.Output(), "       %s graph [-format dot|mermaid] <url or filepath>\n", programName)
+		fmt.Fprintf(flagSet.Output(), "       %s validate <url or filepath> ...\n\n", programName)
 		flagSet.PrintDefaults()
 	}
 
-	var maxWorkers uint64
-	flagSet.Uint64Var(&maxWorkers, "max_workers", 0, "limits the number of workers that can run concurrently (default 0 or limitless)")
+	var opts RunOptions
+	addRunFlags(flagSet, &opts)
+	flagSet.Var((*stringsFlag)(&opts.Jobs), "job", "only runs this job and its dependencies. It can be repeated to run multiple jobs")
+	flagSet.BoolVar(&opts.DryRun, "dry_run", false, "prints what would be executed in which order without executing anything")
+	var eventsPath string
+	flagSet.StringVar(&eventsPath, "events", "", "writes the lifecycle events of the run as newline-delimited JSON to a file, or stdout if -")
+	var resumable bool
+	flagSet.BoolVar(&resumable, "resumable", false, "records the progress of the run in -state_dir, so that it can be resumed when it fails")
+	var resumeID string
+	flagSet.StringVar(&resumeID, "resume", "", "resumes a failed run that was started with -resumable by its ID, where only the jobs that didn't succeed will run. The configs of the run are used when none are given")
+	var junitPath string
+	flagSet.StringVar(&junitPath, "junit", "", "writes a JUnit XML report to a file, where every job is a testsuite and every step is a testcase")
+	var mode string
+	flagSet.StringVar(&mode, "mode", ModeSequential, "how multiple configs are run: sequential, concurrent, or merged into one graph. A resumed run uses the mode of the run when it isn't set")
 	flagSet.Parse(args)
 	args = flagSet.Args()
 
+	modeSet := false
+	flagSet.Visit(func(f *flag.Flag) {
+		modeSet = modeSet || f.Name == "mode"
+	})
+
+	if resumeID != "" && opts.StateDir == "" {
+		fmt.Println("-resume requires -state_dir")
+		return 2
+	}
+
+	if resumable && opts.StateDir == "" {
+		fmt.Println("-resumable requires -state_dir")
+		return 2
+	}
+
+	runID := resumeID
+	var states []*RunState
+	if resumeID != "" {
+		var err error
+		states, err = loadRunStates(opts.StateDir, resumeID)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+
+		if len(args) == 0 {
+			for _, state := range states {
+				args = append(args, state.Config)
+			}
+		}
+
+		if len(args) != len(states) {
+			fmt.Printf("%s run had %d config(s), but got %d\n", resumeID, len(states), len(args))
+			return 2
+		}
+
+		if !modeSet && states[0].Mode != "" {
+			mode = states[0].Mode
+		}
+	}
+
+	if mode != ModeSequential && mode != ModeConcurrent && mode != ModeMerged {
+		fmt.Printf("unknown mode %s, it has to be sequential, concurrent, or merged\n", mode)
+		return 2
+	}
+
 	if len(args) == 0 {
 		flagSet.Usage()
 		return 2
 	}
 
-	configs := make([]Config, len(args))
-	for i, configPath := range args {
-		cfg, err := NewConfig(configPath)
+	if eventsPath != "" {
+		events, closeEvents, err := openEventLog(eventsPath)
+		if err != nil {
+			fmt.Println(err)
+			return 2
+		}
+		defer closeEvents()
+		opts.Events = events
+	}
+
+	var configs []Config
+	if mode == ModeMerged {
+		cfg, err := mergeConfigs(args)
 		if err != nil {
 			fmt.Println(err)
 			return 2
 		}
-		configs[i] = cfg
+		configs = append(configs, cfg)
+	} else {
+		for _, configPath := range args {
+			cfg, err := NewConfig(configPath)
+			if err != nil {
+				fmt.Println(err)
+				return 2
+			}
+			configs = append(configs, cfg)
+		}
 	}
 
-	for _, config := range configs {
-		err := Run(config, os.Stdout, os.Stderr, maxWorkers)
+	if resumable && resumeID == "" && !opts.DryRun {
+		runID = newRunID()
+		var err error
+		states, err = newRunStates(opts.StateDir, runID, mode, args)
 		if err != nil {
 			fmt.Println(err)
 			return 2
 		}
 	}
+
+	if junitPath != "" {
+		opts.JUnit = &JUnitReport{}
+		start := time.Now()
+		defer func() {
+			opts.JUnit.SetTime(time.Since(start))
+			if err := opts.JUnit.WriteFile(junitPath); err != nil {
+				fmt.Println(err)
+			}
+		}()
+	}
+
+	ctx, stop := notifyInterrupt()
+	defer stop()
+	opts.Context = ctx
+	opts.Stdout = os.Stdout
+	opts.Stderr = os.Stderr
+
+	// The merged jobs have unique IDs, so they're all recorded in the first state
+	runStates := states
+	if mode == ModeMerged && states != nil {
+		runStates = states[:1]
+	}
+
+	failed := false
+	for i, err := range runConfigs(mode, configs, runStates, opts) {
+		if err == nil {
+			continue
+		}
+
+		failed = true
+		if len(configs) > 1 {
+			fmt.Printf("%s: %v\n", args[i], err)
+		} else {
+			fmt.Println(err)
+		}
+	}
+
+	if failed {
+		if states != nil {
+			fmt.Printf("to resume the run: %s run -resume %s\n", programName, runID)
+		}
+		return 2
+	}
+
+	// A run that succeeded can't be resumed, so its state isn't needed anymore
+	if states != nil {
+		os.RemoveAll(runStateDir(opts.StateDir, runID))
+	}
+	return 0
+}
+
+// startWatch runs the jobs from the config in args, and runs them again when
+// their inputs or cache paths change until it's interrupted
+func startWatch(programName string, args ...string) int {
+	flagSet := flag.NewFlagSet(programName, flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s <url or filepath>\n\n", programName)
+		flagSet.PrintDefaults()
+	}
+
+	var opts RunOptions
+	addRunFlags(flagSet, &opts)
+	var debounce time.Duration
+	flagSet.DurationVar(&debounce, "debounce", defaultDebounce, "how long the files have to stay unchanged before the affected jobs run again")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+
+	if len(args) != 1 {
+		flagSet.Usage()
+		return 2
+	}
+
+	cfg, err := NewConfig(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	patterns := watchPatterns(graph)
+	if len(patterns) == 0 {
+		fmt.Println("no job has inputs or cache paths to watch")
+		return 2
+	}
+
+	w, err := newWatcher(patterns)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	defer w.Close()
+
+	ctx, stop := notifyInterrupt()
+	defer stop()
+	opts.Context = ctx
+	opts.Stdout = os.Stdout
+	opts.Stderr = os.Stderr
+	if err := watch(cfg, opts, w, debounce); err != nil {
+		fmt.Println(err)
+		return 2
+	}
+	return 0
+}
+
+// startValidate checks the configs in args without running anything, and prints
+// every problem that was found
+func startValidate(programName string, args ...string) int {
+	flagSet := flag.NewFlagSet(programName, flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s <url or filepath> ...\n", programName)
+	}
+	flagSet.Parse(args)
+	args = flagSet.Args()
+
+	if len(args) == 0 {
+		flagSet.Usage()
+		return 2
+	}
+
+	code := 0
+	for _, configPath := range args {
+		cfg, err := NewConfig(configPath)
+		if err == nil {
+			_, err = NewGraph(cfg)
+		}
+
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			for _, problem := range validationErr.Problems {
+				fmt.Println(problem)
+			}
+			code = 2
+		} else if err != nil {
+			fmt.Printf("%s: %v\n", configPath, err)
+			code = 2
+		} else {
+			fmt.Printf("%s is valid\n", configPath)
+		}
+	}
+	return code
+}
+
+// startGraph prints the dependency graph of the config in args
+func startGraph(programName string, args ...string) int {
+	flagSet := flag.NewFlagSet(programName, flag.ExitOnError)
+	flagSet.Usage = func() {
+		fmt.Fprintf(flagSet.Output(), "Usage: %s <url or filepath>\n\n", programName)
+		flagSet.PrintDefaults()
+	}
+
+	var format string
+	flagSet.StringVar(&format, "format", GraphFormatDOT, "the graph format: dot or mermaid")
+	flagSet.Parse(args)
+	args = flagSet.Args()
+
+	if len(args) != 1 {
+		flagSet.Usage()
+		return 2
+	}
+
+	cfg, err := NewConfig(args[0])
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
+
+	err = WriteGraph(os.Stdout, graph, format)
+	if err != nil {
+		fmt.Println(err)
+		return 2
+	}
 	return 0
 }
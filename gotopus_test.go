@@ -4,8 +4,10 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestStartWithNoConfigs(t *testing.T) {
@@ -105,3 +107,216 @@ jobs:
 		t.Fatalf("expected program to exit with non-zero, but got %d", code)
 	}
 }
+
+func TestNotifyInterrupt(t *testing.T) {
+	ctx, stop := notifyInterrupt()
+	defer stop()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = p.Signal(os.Interrupt)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected the context to be cancelled after an interrupt")
+	}
+}
+
+func TestNotifyInterruptTwice(t *testing.T) {
+	exited := make(chan int, 1)
+	exit = func(code int) { exited <- code }
+	defer func() { exit = os.Exit }()
+
+	ctx, stop := notifyInterrupt()
+	defer stop()
+
+	cmd := executeCmd("trap '' TERM; sleep 10")
+	done := make(chan error, 1)
+	go func() { done <- runCmd(ctx, cmd, time.Minute) }()
+
+	p, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for {
+		runningCmds.Lock()
+		_, running := runningCmds.cmds[cmd]
+		runningCmds.Unlock()
+		if running {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	if err := p.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+	<-ctx.Done()
+
+	if err := p.Signal(os.Interrupt); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case code := <-exited:
+		if code != interruptedExitCode {
+			t.Fatalf("expected to exit with %d, but got %d", interruptedExitCode, code)
+		}
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected to exit after the second interrupt")
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 2):
+		t.Fatal("expected the command to be killed after the second interrupt")
+	}
+}
+
+func TestStartGraph(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "test_*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	yamlStr := `
+jobs:
+  job1:
+    steps:
+      - run: echo "job1"
+  job2:
+    needs:
+      - job1`
+
+	_, err = io.Copy(tmp, strings.NewReader(yamlStr))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := Start("test", "graph", "-format", "mermaid", tmp.Name())
+	if code != 0 {
+		t.Fatalf("expected program to exit with 0, but got %d", code)
+	}
+
+	code = Start("test", "graph", "-format", "png", tmp.Name())
+	if code == 0 {
+		t.Fatalf("expected program to exit with non-zero, but got %d", code)
+	}
+}
+
+func TestStartValidate(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "test_*.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	_, err = io.Copy(tmp, strings.NewReader("jobs:\n  job1:\n    stpes:\n      - run: echo\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code := Start("test", "validate", "examples/basic.yaml")
+	if code != 0 {
+		t.Fatalf("expected program to exit with 0, but got %d", code)
+	}
+
+	code = Start("test", "validate", "examples/basic.yaml", tmp.Name())
+	if code == 0 {
+		t.Fatalf("expected program to exit with non-zero, but got %d", code)
+	}
+}
+
+func TestStartResume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	counter := filepath.Join(dir, "counter")
+	fixed := filepath.Join(dir, "fixed")
+	config := filepath.Join(dir, "config.yaml")
+	yamlStr := `
+jobs:
+  build:
+    steps:
+      - run: echo build >> ` + counter + `
+  test:
+    needs: [build]
+    steps:
+      - run: test -f ` + fixed
+	if err := ioutil.WriteFile(config, []byte(yamlStr), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stateDir := filepath.Join(dir, "state")
+	code := Start("test", "-resumable", "-state_dir", stateDir, config)
+	if code == 0 {
+		t.Fatal("expected the first run to fail")
+	}
+
+	runs, err := ioutil.ReadDir(filepath.Join(stateDir, "runs"))
+	if err != nil || len(runs) != 1 {
+		t.Fatalf("expected the run state to be kept, but got %v", err)
+	}
+
+	ioutil.WriteFile(fixed, nil, 0644)
+	code = Start("test", "run", "-state_dir", stateDir, "-resume", runs[0].Name())
+	if code != 0 {
+		t.Fatalf("expected the resumed run to succeed, but got %d", code)
+	}
+
+	data, _ := ioutil.ReadFile(counter)
+	if string(data) != "build\n" {
+		t.Fatalf("expected build to only run once, but got \"%s\"", string(data))
+	}
+
+	if _, err := os.Stat(filepath.Join(stateDir, "runs", runs[0].Name())); !os.IsNotExist(err) {
+		t.Fatal("expected the run state to be removed after the run succeeded")
+	}
+}
+
+func TestStartWithMode(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	backend := filepath.Join(dir, "backend.yaml")
+	frontend := filepath.Join(dir, "frontend.yaml")
+	ioutil.WriteFile(backend, []byte("jobs:\n  build:\n    steps:\n      - run: exit 0\n"), 0644)
+	ioutil.WriteFile(frontend, []byte("jobs:\n  test:\n    needs: [backend/build]\n    steps:\n      - run: exit 0\n"), 0644)
+
+	code := Start("test", "-mode", "merged", backend, frontend)
+	if code != 0 {
+		t.Fatalf("expected program to exit with 0, but got %d", code)
+	}
+
+	// frontend/test needs a job from another config, which only exists when they're merged
+	code = Start("test", "-mode", "concurrent", backend, frontend)
+	if code == 0 {
+		t.Fatal("expected program to exit with non-zero")
+	}
+
+	code = Start("test", "-mode", "parallel", backend)
+	if code == 0 {
+		t.Fatal("expected program to exit with non-zero due to an unknown mode")
+	}
+}
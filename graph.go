@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"sort"
 	"strings"
 )
 
@@ -10,6 +11,11 @@ type Node struct {
 	Job
 	// ID is a unique ID of the node within a graph
 	ID string
+	// JobID is the ID of the job in the config. It's different from ID when the
+	// job has a matrix, because every combination becomes a separate node.
+	JobID string
+	// Matrix is the combination of matrix values that the node runs with
+	Matrix map[string]string
 	// Dependencies is a set of nodes that are required to resolve a node
 	Dependencies map[*Node]struct{}
 	// Dependents is a set of nodes that are waiting for a node to resolve
@@ -21,101 +27,431 @@ func NewNode(j Job, id string) *Node {
 	return &Node{
 		Job:          j,
 		ID:           id,
+		JobID:        id,
 		Dependencies: make(map[*Node]struct{}),
 		Dependents:   make(map[*Node]struct{}),
 	}
 }
 
-// detectCircularDependency traverses the whole graph and find a circular dependency.
-// When a circular dependency, the function will return an error with a friendly message
-// to show where the circular dependency occurred.
-func detectCircularDependency(root *Node) error {
-	unresolved := make(map[*Node]struct{})
-	resolved := make(map[*Node]struct{})
-	var resolve func(*Node) []*Node
-	resolve = func(n *Node) []*Node {
-		if n == nil {
-			return nil
-		}
+// sortedNodes returns the nodes from set sorted by ID
+func sortedNodes(set map[*Node]struct{}) []*Node {
+	nodes := make([]*Node, 0, len(set))
+	for node := range set {
+		nodes = append(nodes, node)
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
+	return nodes
+}
 
-		unresolved[n] = struct{}{}
+// Descendants returns every node that transitively depends on n, sorted by ID
+func (n *Node) Descendants() []*Node {
+	visited := make(map[*Node]struct{})
+	var visit func(*Node)
+	visit = func(n *Node) {
 		for dependent := range n.Dependents {
-			if _, ok := resolved[dependent]; ok {
+			if _, ok := visited[dependent]; ok {
 				continue
 			}
 
-			// Detect a cycle
-			if _, ok := unresolved[dependent]; ok {
-				return []*Node{dependent, n}
+			visited[dependent] = struct{}{}
+			visit(dependent)
+		}
+	}
+	visit(n)
+	return sortedNodes(visited)
+}
+
+// Waves groups every node that transitively depends on n in the order that they
+// would be released by the scheduler once n is resolved. The first wave contains
+// the nodes that only depend on n, the second wave contains the nodes that are
+// unblocked by the first wave, and so on. Nodes within a wave are sorted by ID.
+func (n *Node) Waves() [][]*Node {
+	doneNodes := map[*Node]struct{}{n: {}}
+	waitingNodes := make(map[*Node]struct{})
+	for _, node := range n.Descendants() {
+		waitingNodes[node] = struct{}{}
+	}
+
+	var waves [][]*Node
+	for {
+		wave := nextRunnableNodes(waitingNodes, doneNodes)
+		if len(wave) == 0 {
+			return waves
+		}
+
+		sort.Slice(wave, func(i, j int) bool {
+			return wave[i].ID < wave[j].ID
+		})
+		for _, node := range wave {
+			doneNodes[node] = struct{}{}
+			delete(waitingNodes, node)
+		}
+		waves = append(waves, wave)
+	}
+}
+
+// Prune returns a new graph that only contains the nodes with ids and everything
+// that they transitively depend on, like running "make <target>". An ID of a matrix
+// job selects all of its combinations. n must be a graph root from NewGraph, and
+// it's left untouched.
+func (n *Node) Prune(ids []string) (*Node, error) {
+	nodes := make(map[string][]*Node)
+	for _, node := range n.Descendants() {
+		nodes[node.ID] = append(nodes[node.ID], node)
+		if node.JobID != node.ID {
+			nodes[node.JobID] = append(nodes[node.JobID], node)
+		}
+	}
+
+	selected := make(map[*Node]struct{})
+	var selectNode func(*Node)
+	selectNode = func(node *Node) {
+		if _, ok := selected[node]; ok {
+			return
+		}
+
+		selected[node] = struct{}{}
+		for dep := range node.Dependencies {
+			selectNode(dep)
+		}
+	}
+
+	for _, id := range ids {
+		matched, ok := nodes[id]
+		if !ok {
+			return nil, fmt.Errorf("failed to find %s job", id)
+		}
+
+		for _, node := range matched {
+			selectNode(node)
+		}
+	}
+
+	pruned := make(map[*Node]*Node, len(selected))
+	for node := range selected {
+		prunedNode := NewNode(node.Job, node.ID)
+		prunedNode.JobID = node.JobID
+		prunedNode.Matrix = node.Matrix
+		pruned[node] = prunedNode
+	}
+
+	rootNode := NewNode(Job{}, n.ID)
+	for node, prunedNode := range pruned {
+		for dep := range node.Dependencies {
+			prunedDep := pruned[dep]
+			prunedNode.Dependencies[prunedDep] = struct{}{}
+			prunedDep.Dependents[prunedNode] = struct{}{}
+		}
+
+		if len(prunedNode.Dependencies) == 0 {
+			rootNode.Dependents[prunedNode] = struct{}{}
+		}
+	}
+	return rootNode, nil
+}
+
+// Cycle is a group of jobs that need each other
+type Cycle struct {
+	// Path goes from the job with the smallest ID along the needs of the jobs, and
+	// ends with the same job, e.g. [a b a] when a needs b and b needs a
+	Path []string
+	// Needs describes every needs between the jobs of the cycle sorted by job ID.
+	// When the config is known, it starts with the position of the needs.
+	Needs []string
+}
+
+// CircularDependencyError reports every cycle in a graph
+type CircularDependencyError struct {
+	// Cycles are sorted by the first job of their paths
+	Cycles []Cycle
+}
+
+func (e *CircularDependencyError) Error() string {
+	var lines []string
+	indent := "  "
+	if len(e.Cycles) == 1 {
+		lines = append(lines, "detected a circular dependency: "+strings.Join(e.Cycles[0].Path, "->"))
+	} else {
+		lines = append(lines, fmt.Sprintf("detected %d circular dependencies:", len(e.Cycles)))
+		indent = "    "
+	}
+
+	for _, cycle := range e.Cycles {
+		if len(e.Cycles) > 1 {
+			lines = append(lines, "  "+strings.Join(cycle.Path, "->"))
+		}
+
+		for _, need := range cycle.Needs {
+			lines = append(lines, indent+need)
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// describeNeed describes that n needs dep, starting with the position of the needs
+// when it's known
+func describeNeed(n, dep *Node) string {
+	description := fmt.Sprintf("%s needs %s", n.ID, dep.ID)
+	for i, depID := range n.Job.Needs {
+		if depID == dep.JobID && i < len(n.Job.needsPositions) {
+			return fmt.Sprintf("%s: %s", n.Job.needsPositions[i], description)
+		}
+	}
+	return description
+}
+
+// detectCircularDependency finds every cycle between nodes with Tarjan's strongly
+// connected components algorithm. Every component with more than one node, or with
+// a node that needs itself, is reported as a cycle in a *CircularDependencyError.
+// The nodes and their dependencies are visited in the order of their IDs, so the
+// cycles are always reported the same way.
+func detectCircularDependency(nodes []*Node) error {
+	set := make(map[*Node]struct{}, len(nodes))
+	for _, n := range nodes {
+		set[n] = struct{}{}
+	}
+
+	var (
+		index    int
+		indices  = make(map[*Node]int)
+		lowLinks = make(map[*Node]int)
+		onStack  = make(map[*Node]bool)
+		stack    []*Node
+		cycles   []Cycle
+	)
+
+	var connect func(*Node)
+	connect = func(n *Node) {
+		indices[n] = index
+		lowLinks[n] = index
+		index++
+		stack = append(stack, n)
+		onStack[n] = true
+
+		for _, dep := range sortedNodes(n.Dependencies) {
+			if _, ok := indices[dep]; !ok {
+				connect(dep)
+				if lowLinks[dep] < lowLinks[n] {
+					lowLinks[n] = lowLinks[dep]
+				}
+			} else if onStack[dep] && indices[dep] < lowLinks[n] {
+				lowLinks[n] = indices[dep]
 			}
+		}
+
+		if lowLinks[n] != indices[n] {
+			return
+		}
 
-			cycle := resolve(dependent)
-			if len(cycle) > 0 {
-				return append(cycle, n)
+		component := make(map[*Node]struct{})
+		for {
+			top := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			onStack[top] = false
+			component[top] = struct{}{}
+			if top == n {
+				break
 			}
 		}
 
-		delete(unresolved, n)
-		resolved[n] = struct{}{}
+		if _, needsItself := n.Dependencies[n]; len(component) > 1 || needsItself {
+			cycles = append(cycles, newCycle(component))
+		}
+	}
+
+	for _, n := range sortedNodes(set) {
+		if _, ok := indices[n]; !ok {
+			connect(n)
+		}
+	}
+
+	if len(cycles) == 0 {
 		return nil
 	}
 
-	cycle := resolve(root)
-	if len(cycle) > 0 {
-		deps := make([]string, len(cycle)-1)
-		for i, c := range cycle[:len(cycle)-1] {
-			deps[i] = c.ID
+	sort.Slice(cycles, func(i, j int) bool {
+		return cycles[i].Path[0] < cycles[j].Path[0]
+	})
+	return &CircularDependencyError{Cycles: cycles}
+}
+
+// newCycle describes a strongly connected component. Its path is the shortest
+// cycle through the node with the smallest ID.
+func newCycle(component map[*Node]struct{}) Cycle {
+	members := sortedNodes(component)
+	start := members[0]
+
+	// Breadth-first search from start along the needs until start is reached again
+	previous := make(map[*Node]*Node)
+	queue := []*Node{start}
+	var last *Node
+	for last == nil {
+		n := queue[0]
+		queue = queue[1:]
+		for _, dep := range sortedNodes(n.Dependencies) {
+			if _, ok := component[dep]; !ok {
+				continue
+			}
+
+			if dep == start {
+				last = n
+				break
+			}
+
+			if _, ok := previous[dep]; !ok {
+				previous[dep] = n
+				queue = append(queue, dep)
+			}
+		}
+	}
+
+	path := []string{start.ID}
+	for n := last; n != start; n = previous[n] {
+		path = append(path, n.ID)
+	}
+	path = append(path, start.ID)
+	// The path was collected backwards from the end
+	for i, j := 1, len(path)-2; i < j; i, j = i+1, j-1 {
+		path[i], path[j] = path[j], path[i]
+	}
+
+	var needs []string
+	for _, n := range members {
+		for _, dep := range sortedNodes(n.Dependencies) {
+			if _, ok := component[dep]; ok {
+				needs = append(needs, describeNeed(n, dep))
+			}
+		}
+	}
+	return Cycle{Path: path, Needs: needs}
+}
+
+// validateExpressions parses the expressions of job to report syntax errors
+// before anything runs
+func validateExpressions(id string, job Job) error {
+	if err := validateInterpolation(job.Cache.Key); err != nil {
+		return fmt.Errorf("%s job has an invalid cache key: %w", id, err)
+	}
+
+	if job.If != "" {
+		if _, err := ParseExpr(job.If); err != nil {
+			return fmt.Errorf("%s job has an invalid if: %w", id, err)
+		}
+	}
+
+	for i, step := range job.Steps {
+		if step.If == "" {
+			continue
+		}
+
+		if _, err := ParseExpr(step.If); err != nil {
+			return fmt.Errorf("%s job has an invalid if in step %s: %w", id, stepLabel(i, step), err)
 		}
-		depsStr := strings.Join(deps, "->")
-		return fmt.Errorf("detected a circular dependency: %s", depsStr)
 	}
 	return nil
 }
 
-// NewGraph constructs a dependency graph based on given config
+// NewGraph constructs a dependency graph based on given config. A job with a matrix
+// is expanded into a node for every combination, and needing that job means needing
+// all of its combinations. The jobs that use templates are expanded first.
 func NewGraph(cfg Config) (*Node, error) {
+	cfg, err := expandTemplates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	nodes := make(map[string]*Node)
+	nodesByJob := make(map[string][]*Node)
 	for id, job := range cfg.Jobs {
-		nodes[id] = NewNode(job, id)
+		if err := validateExpressions(id, job); err != nil {
+			return nil, err
+		}
+
+		if err := validateService(id, job); err != nil {
+			return nil, err
+		}
+
+		if job.Strategy.Matrix.IsEmpty() {
+			node := NewNode(job, id)
+			nodes[id] = node
+			nodesByJob[id] = []*Node{node}
+			continue
+		}
+
+		combinations := job.Strategy.Matrix.Combinations()
+		nodesByJob[id] = make([]*Node, 0, len(combinations))
+		for _, combination := range combinations {
+			node := NewNode(job, matrixID(id, combination))
+			node.JobID = id
+			node.Matrix = combination
+			if _, ok := nodes[node.ID]; ok {
+				return nil, fmt.Errorf("%s job has a duplicate matrix combination: %s", id, node.ID)
+			}
+
+			nodes[node.ID] = node
+			nodesByJob[id] = append(nodesByJob[id], node)
+		}
 	}
 
 	if len(nodes) == 0 {
 		return nil, fmt.Errorf("there are no jobs")
 	}
 
-	for id, task := range cfg.Jobs {
-		node := nodes[id]
-		for _, depID := range task.Needs {
-			dep, ok := nodes[depID]
+	for _, node := range nodes {
+		for _, depID := range node.Job.Needs {
+			deps, ok := nodesByJob[depID]
 			if !ok {
 				return nil, fmt.Errorf("failed to find %s dependency", depID)
 			}
 
-			node.Dependencies[dep] = struct{}{}
-			dep.Dependents[node] = struct{}{}
+			for _, dep := range deps {
+				node.Dependencies[dep] = struct{}{}
+				dep.Dependents[node] = struct{}{}
+			}
 		}
 	}
 
+	allNodes := make([]*Node, 0, len(nodes))
+	for _, node := range nodes {
+		allNodes = append(allNodes, node)
+	}
+
+	if err := detectCircularDependency(allNodes); err != nil {
+		return nil, err
+	}
+
+	if err := detectNeedsEnvCollision(allNodes); err != nil {
+		return nil, err
+	}
+
 	rootNode := NewNode(Job{}, "root")
 	for _, node := range nodes {
 		if len(node.Dependencies) == 0 {
 			rootNode.Dependents[node] = struct{}{}
 		}
 	}
+	return rootNode, nil
+}
 
-	// If this is true, it's definitely a cycle. But, we'll still attach one
-	// of the nodes so that we can still detect what dependencies that caused
-	// the cycle
-	if len(rootNode.Dependents) == 0 {
-		for _, node := range nodes {
-			rootNode.Dependents[node] = struct{}{}
-			break
-		}
-	}
+// detectNeedsEnvCollision makes sure that the outputs of the dependencies of every
+// node get distinct environment variables, e.g. a-b and a_b would both get
+// GOTOPUS_NEEDS_A_B_<KEY>
+func detectNeedsEnvCollision(nodes []*Node) error {
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].ID < nodes[j].ID
+	})
 
-	err := detectCircularDependency(rootNode)
-	if err != nil {
-		return nil, err
+	for _, node := range nodes {
+		depIDs := make(map[string]string, len(node.Dependencies))
+		for _, dep := range sortedNodes(node.Dependencies) {
+			name := envName(dep.ID)
+			if other, ok := depIDs[name]; ok {
+				return fmt.Errorf("%s job needs %s and %s jobs, but both of their outputs would be passed as GOTOPUS_NEEDS_%s_<KEY>", node.ID, other, dep.ID, name)
+			}
+			depIDs[name] = dep.ID
+		}
 	}
-	return rootNode, nil
+	return nil
 }
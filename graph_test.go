@@ -5,23 +5,24 @@ import (
 	"testing"
 )
 
+// addNeeds makes n depend on deps
+func addNeeds(n *Node, deps ...*Node) {
+	for _, dep := range deps {
+		n.Dependencies[dep] = struct{}{}
+		dep.Dependents[n] = struct{}{}
+	}
+}
+
 func TestDetectCircularDependencySimple(t *testing.T) {
 	a := NewNode(Job{}, "a")
 	b := NewNode(Job{}, "b")
-	a.Dependents[b] = struct{}{}
-	b.Dependents[a] = struct{}{}
-	root := NewNode(Job{}, "root")
-	root.Dependents[a] = struct{}{}
-
-	expectedCycle := "a->b->a"
-	err := detectCircularDependency(root)
-	if err == nil {
-		t.Fatalf("failed to detect a circular dependency: %s", expectedCycle)
-	}
+	addNeeds(a, b)
+	addNeeds(b, a)
 
-	msg := err.Error()
-	if !strings.Contains(msg, expectedCycle) {
-		t.Fatalf("epexcting the error message to contain \"%s\", but got \"%s\"", expectedCycle, msg)
+	expected := "detected a circular dependency: a->b->a\n  a needs b\n  b needs a"
+	err := detectCircularDependency([]*Node{b, a})
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%v\"", expected, err)
 	}
 }
 
@@ -32,33 +33,54 @@ func TestDetectCircularDependencyMoreThanOneDependents(t *testing.T) {
 	d := NewNode(Job{}, "d")
 	e := NewNode(Job{}, "e")
 
-	root := NewNode(Job{}, "root")
-	root.Dependents[a] = struct{}{}
-	root.Dependents[b] = struct{}{}
+	addNeeds(c, a)
+	addNeeds(d, a, e)
+	addNeeds(e, b, d)
 
-	a.Dependents[c] = struct{}{}
-	a.Dependents[d] = struct{}{}
-	d.Dependents[e] = struct{}{}
+	expected := "detected a circular dependency: d->e->d\n  d needs e\n  e needs d"
+	for i := 0; i < 10; i++ {
+		err := detectCircularDependency([]*Node{e, d, c, b, a})
+		if err == nil || err.Error() != expected {
+			t.Fatalf("expected the error to be \"%s\", but got \"%v\"", expected, err)
+		}
+	}
+}
 
-	b.Dependents[e] = struct{}{}
-	e.Dependents[d] = struct{}{}
+func TestDetectCircularDependencyMultipleCycles(t *testing.T) {
+	a := NewNode(Job{}, "a")
+	b := NewNode(Job{}, "b")
+	c := NewNode(Job{}, "c")
+	d := NewNode(Job{}, "d")
+	e := NewNode(Job{}, "e")
+	f := NewNode(Job{}, "f")
 
-	expectedCycles := []string{"d->e->d->a", "e->d->e->b"}
-	err := detectCircularDependency(root)
-	if err == nil {
-		t.Fatalf("failed to detect a circular dependency: \"%s\" or \"%s\"", expectedCycles[0], expectedCycles[1])
+	addNeeds(a, b)
+	addNeeds(b, c)
+	addNeeds(c, a, b)
+	addNeeds(d, a)
+	addNeeds(e, e)
+	addNeeds(f, d)
+
+	err := detectCircularDependency([]*Node{f, e, d, c, b, a})
+	cycleErr, ok := err.(*CircularDependencyError)
+	if !ok {
+		t.Fatalf("expected to get a *CircularDependencyError, but got %v", err)
 	}
 
-	msg := err.Error()
-	var found bool
-	for _, expectedCycle := range expectedCycles {
-		if strings.Contains(msg, expectedCycle) {
-			found = true
-		}
+	if len(cycleErr.Cycles) != 2 {
+		t.Fatalf("expected to get 2 cycles, but got %v", cycleErr.Cycles)
 	}
 
-	if !found {
-		t.Fatalf("epexcting the error message to contain \"%s\" or \"%s\", but got \"%s\"", expectedCycles[0], expectedCycles[1], msg)
+	expected := `detected 2 circular dependencies:
+  a->b->c->a
+    a needs b
+    b needs c
+    c needs a
+    c needs b
+  e->e
+    e needs e`
+	if err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%v\"", expected, err)
 	}
 }
 
@@ -70,24 +92,18 @@ func TestDetectCircularDependencyNoCycle(t *testing.T) {
 	e := NewNode(Job{}, "e")
 	f := NewNode(Job{}, "f")
 
-	root := NewNode(Job{}, "root")
-	root.Dependents[a] = struct{}{}
-	root.Dependents[b] = struct{}{}
-
-	a.Dependents[c] = struct{}{}
-	a.Dependents[d] = struct{}{}
-	d.Dependents[e] = struct{}{}
-
-	b.Dependents[e] = struct{}{}
-	e.Dependents[f] = struct{}{}
+	addNeeds(c, a)
+	addNeeds(d, a)
+	addNeeds(e, d, b)
+	addNeeds(f, e)
 
-	err := detectCircularDependency(root)
+	err := detectCircularDependency([]*Node{a, b, c, d, e, f})
 	if err != nil {
 		t.Fatalf("expected no cycle, but got \"%s\"", err.Error())
 	}
 }
 
-func TestDetectCircularDependencyWhenNil(t *testing.T) {
+func TestDetectCircularDependencyWhenEmpty(t *testing.T) {
 	err := detectCircularDependency(nil)
 	if err != nil {
 		t.Fatal(err)
@@ -197,6 +213,29 @@ func TestNewGraphWithCircularDependency(t *testing.T) {
 	}
 }
 
+func TestNewGraphWithCircularDependencyPositions(t *testing.T) {
+	configRaw := `jobs:
+  build:
+    needs: [lint, test]
+  lint:
+    steps:
+      - run: make lint
+  test:
+    needs:
+      - build`
+
+	cfg, err := decodeConfig("ci.yaml", strings.NewReader(configRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "detected a circular dependency: build->test->build\n  ci.yaml:3:19: build needs test\n  ci.yaml:9:9: test needs build"
+	_, err = NewGraph(cfg)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%v\"", expected, err)
+	}
+}
+
 func TestNewGraphDependencyNotExist(t *testing.T) {
 	var cfg Config
 	var job Job
@@ -210,3 +249,185 @@ func TestNewGraphDependencyNotExist(t *testing.T) {
 		t.Fatal("expected to get an error")
 	}
 }
+
+func TestNodeDescendants(t *testing.T) {
+	a := NewNode(Job{}, "a")
+	b := NewNode(Job{}, "b")
+	c := NewNode(Job{}, "c")
+	d := NewNode(Job{}, "d")
+
+	a.Dependents[c] = struct{}{}
+	b.Dependents[c] = struct{}{}
+	c.Dependents[d] = struct{}{}
+	root := NewNode(Job{}, "root")
+	root.Dependents[b] = struct{}{}
+	root.Dependents[a] = struct{}{}
+
+	var ids []string
+	for _, node := range root.Descendants() {
+		ids = append(ids, node.ID)
+	}
+
+	expected := "a,b,c,d"
+	if actual := strings.Join(ids, ","); actual != expected {
+		t.Fatalf("expected the descendants to be %s, but got %s", expected, actual)
+	}
+}
+
+func TestNodeWaves(t *testing.T) {
+	var job Job
+	cfg := Config{Jobs: map[string]Job{}}
+	cfg.Jobs["b"] = job
+	cfg.Jobs["a"] = job
+	job.Needs = []string{"a"}
+	cfg.Jobs["c"] = job
+	job.Needs = []string{"a", "c"}
+	cfg.Jobs["d"] = job
+	job.Needs = []string{"b"}
+	cfg.Jobs["e"] = job
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var waves []string
+	for _, wave := range graph.Waves() {
+		var ids []string
+		for _, node := range wave {
+			ids = append(ids, node.ID)
+		}
+		waves = append(waves, strings.Join(ids, ","))
+	}
+
+	expected := "a,b|c,e|d"
+	if actual := strings.Join(waves, "|"); actual != expected {
+		t.Fatalf("expected the waves to be %s, but got %s", expected, actual)
+	}
+}
+
+func TestNodePrune(t *testing.T) {
+	var job Job
+	cfg := Config{Jobs: map[string]Job{}}
+	cfg.Jobs["a"] = job
+	cfg.Jobs["b"] = job
+	job.Needs = []string{"a"}
+	cfg.Jobs["c"] = job
+	job.Needs = []string{"c"}
+	cfg.Jobs["d"] = job
+	job.Needs = []string{"b"}
+	cfg.Jobs["e"] = job
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	pruned, err := graph.Prune([]string{"d"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, node := range pruned.Descendants() {
+		ids = append(ids, node.ID)
+	}
+
+	expected := "a,c,d"
+	if actual := strings.Join(ids, ","); actual != expected {
+		t.Fatalf("expected the pruned graph to contain %s, but got %s", expected, actual)
+	}
+
+	if len(pruned.Dependents) != 1 {
+		t.Fatalf("expected the pruned graph to have 1 root dependent, but got %d", len(pruned.Dependents))
+	}
+
+	if len(graph.Descendants()) != 5 {
+		t.Fatal("expected the original graph to be left untouched")
+	}
+}
+
+func TestNodePruneUnknownJob(t *testing.T) {
+	cfg := Config{Jobs: map[string]Job{"a": {}}}
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = graph.Prune([]string{"b"})
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+}
+
+func TestNewGraphWithMatrix(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {Strategy: Strategy{Matrix: Matrix{Values: map[string][]string{"os": {"linux", "darwin"}}}}},
+			"test": {
+				Needs:    []string{"build"},
+				Strategy: Strategy{Matrix: Matrix{Values: map[string][]string{"go": {"1.20", "1.21"}}}},
+			},
+		},
+	}
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for _, node := range graph.Descendants() {
+		ids = append(ids, node.ID)
+	}
+
+	expected := "build(os=darwin),build(os=linux),test(go=1.20),test(go=1.21)"
+	if actual := strings.Join(ids, ","); actual != expected {
+		t.Fatalf("expected the nodes to be %s, but got %s", expected, actual)
+	}
+
+	for _, node := range graph.Descendants() {
+		if node.JobID == "test" && len(node.Dependencies) != 2 {
+			t.Fatalf("expected %s to need every build combination, but got %d dependencies", node.ID, len(node.Dependencies))
+		}
+	}
+
+	pruned, err := graph.Prune([]string{"build"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	descendants := pruned.Descendants()
+	if len(descendants) != 2 || descendants[0].Matrix["os"] != "darwin" {
+		t.Fatalf("expected to select every build combination, but got %d nodes", len(descendants))
+	}
+}
+
+func TestNewGraphWithDuplicateMatrixCombination(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"test": {Strategy: Strategy{Matrix: Matrix{Values: map[string][]string{"go": {"1.20", "1.20"}}}}},
+		},
+	}
+
+	_, err := NewGraph(cfg)
+	if err == nil {
+		t.Fatal("expected to get an error due to a duplicate combination")
+	}
+}
+
+func TestNewGraphWithNeedsEnvCollision(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"lint/go": {},
+			"lint_go": {},
+			"deploy":  {Needs: []string{"lint/go", "lint_go"}},
+		},
+	}
+
+	expected := "deploy job needs lint/go and lint_go jobs, but both of their outputs would be passed as GOTOPUS_NEEDS_LINT_GO_<KEY>"
+	_, err := NewGraph(cfg)
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%v\"", expected, err)
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Include is a config whose jobs are added to the config that includes it. It's
+// written either as the path, or as a mapping with the path and the namespace.
+type Include struct {
+	// Path is a path to a file or a url. A relative path is relative to the config
+	// that includes it
+	Path string `yaml:"path"`
+	// Namespace prefixes the IDs of the included jobs, e.g. the go job included with
+	// the lint namespace is lint/go. If empty, it's the file name of Path without
+	// its extension
+	Namespace string `yaml:"namespace"`
+}
+
+// UnmarshalYAML decodes either a path, or a mapping with the path and the namespace
+func (i *Include) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&i.Path)
+	}
+
+	type include Include
+	return node.Decode((*include)(i))
+}
+
+// namespaced returns the ID of the job id in namespace
+func namespaced(namespace, id string) string {
+	if namespace == "" {
+		return id
+	}
+	return namespace + "/" + id
+}
+
+// resolveInclude returns where includePath is when it's included by the config at parent
+func resolveInclude(parent, includePath string) string {
+	if isURL(includePath) || filepath.IsAbs(includePath) {
+		return includePath
+	}
+
+	if isURL(parent) {
+		base, err := url.Parse(parent)
+		if err != nil {
+			return includePath
+		}
+
+		ref, err := url.Parse(includePath)
+		if err != nil {
+			return includePath
+		}
+		return base.ResolveReference(ref).String()
+	}
+	return filepath.Join(filepath.Dir(parent), includePath)
+}
+
+// defaultNamespace returns the file name of the config at p without its extension
+func defaultNamespace(p string) string {
+	name := filepath.Base(p)
+	if isURL(p) {
+		if u, err := url.Parse(p); err == nil {
+			name = path.Base(u.Path)
+		}
+	}
+	return strings.TrimSuffix(name, path.Ext(name))
+}
+
+// canonicalConfigPath returns the same path for every way of writing where a config is
+func canonicalConfigPath(p string) string {
+	if isURL(p) {
+		return p
+	}
+
+	if abs, err := filepath.Abs(p); err == nil {
+		return abs
+	}
+	return filepath.Clean(p)
+}
+
+// includeCycle returns the configs from the one that includePath refers to, through
+// chain, and back to includePath, or nil when including it doesn't make a cycle
+func includeCycle(chain []string, includePath string) []string {
+	canonical := canonicalConfigPath(includePath)
+	for i, including := range chain {
+		if canonicalConfigPath(including) == canonical {
+			return append(chain[i:len(chain):len(chain)], includePath)
+		}
+	}
+	return nil
+}
+
+// configLoader merges a config with all of the configs that it includes
+type configLoader struct {
+	jobs      map[string]Job
+	templates map[string]Template
+	// namespaces are the namespaces of the configs that define the jobs
+	namespaces map[string]string
+	// loaded maps the configs that have been loaded to their namespaces. A config
+	// that's included without a namespace is only loaded once, and a config that's
+	// included with a namespace is loaded once for every namespace.
+	loaded map[string]string
+	// aliases map the default namespaces of the configs that were included again
+	// without a namespace to the namespaces that they were loaded with
+	aliases map[string]string
+	// paths are the loaded configs in the order that they've been loaded
+	paths    []string
+	problems []Problem
+}
+
+func newConfigLoader() *configLoader {
+	return &configLoader{
+		jobs:       make(map[string]Job),
+		templates:  make(map[string]Template),
+		namespaces: make(map[string]string),
+		loaded:     make(map[string]string),
+		aliases:    make(map[string]string),
+	}
+}
+
+func (l *configLoader) add(position Position, format string, args ...interface{}) {
+	l.problems = append(l.problems, Problem{
+		Position: position,
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+// loadAll loads the config at path and everything that it includes. The templates
+// of the jobs are expanded, and their needs are resolved to the IDs of the jobs in
+// the returned config.
+func (l *configLoader) loadAll(path string) (Config, error) {
+	cfg, err := l.load(path, "", nil)
+	if err != nil {
+		return cfg, err
+	}
+
+	l.expandTemplates()
+	l.resolveNeeds()
+	cfg.Jobs = l.jobs
+	cfg.Templates = l.templates
+	cfg.path = canonicalConfigPath(path)
+	return cfg, l.err()
+}
+
+// load loads the config at path with its jobs in namespace. chain is the configs
+// that include it, so that the include cycles can be detected.
+func (l *configLoader) load(path, namespace string, chain []string) (Config, error) {
+	r, err := openConfig(path)
+	if err != nil {
+		return Config{}, err
+	}
+	defer r.Close()
+
+	cfg, err := decodeConfig(path, r)
+	var validationErr *ValidationError
+	if errors.As(err, &validationErr) {
+		l.problems = append(l.problems, validationErr.Problems...)
+	} else if err != nil {
+		return cfg, err
+	}
+	l.paths = append(l.paths, path)
+
+	ids := make([]string, 0, len(cfg.Jobs))
+	for id := range cfg.Jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		job := cfg.Jobs[id]
+		fullID := namespaced(namespace, id)
+		if defined, ok := l.jobs[fullID]; ok {
+			l.add(job.position, "%s job is already defined at %s", fullID, defined.position)
+			continue
+		}
+
+		l.jobs[fullID] = job
+		l.namespaces[fullID] = namespace
+	}
+
+	names := make([]string, 0, len(cfg.Templates))
+	for name := range cfg.Templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		t := cfg.Templates[name]
+		fullName := namespaced(namespace, name)
+		if defined, ok := l.templates[fullName]; ok {
+			l.add(t.position, "%s template is already defined at %s", fullName, defined.position)
+			continue
+		}
+		l.templates[fullName] = t
+	}
+
+	chain = append(chain[:len(chain):len(chain)], path)
+	for i, include := range cfg.Include {
+		if include.Path == "" || i >= len(cfg.includePositions) {
+			continue
+		}
+		position := cfg.includePositions[i]
+
+		includePath := resolveInclude(path, include.Path)
+		includeNamespace := include.Namespace
+		if includeNamespace == "" {
+			includeNamespace = defaultNamespace(includePath)
+			if !jobIDPattern.MatchString(includeNamespace) {
+				l.add(position, "can't use %q as the namespace of %s, set its namespace instead", includeNamespace, include.Path)
+				continue
+			}
+		}
+		includeNamespace = namespaced(namespace, includeNamespace)
+
+		if cycle := includeCycle(chain, includePath); cycle != nil {
+			l.add(position, "detected an include cycle: %s", strings.Join(cycle, " -> "))
+			continue
+		}
+
+		key := loadedKey(includePath, "")
+		if include.Namespace != "" {
+			key = loadedKey(includePath, includeNamespace)
+		}
+		if loadedNamespace, ok := l.loaded[key]; ok {
+			if loadedNamespace != includeNamespace {
+				l.aliases[includeNamespace] = loadedNamespace
+			}
+			continue
+		}
+		l.loaded[key] = includeNamespace
+
+		if _, err := l.load(includePath, includeNamespace, chain); err != nil {
+			l.add(position, "failed to include %s: %v", include.Path, err)
+		}
+	}
+	return cfg, nil
+}
+
+// loadedKey returns the key of the config at p in configLoader.loaded when it's
+// included with namespace
+func loadedKey(p, namespace string) string {
+	key := canonicalConfigPath(p)
+	if namespace != "" {
+		key += "\x00" + namespace
+	}
+	return key
+}
+
+// lookup returns the full name of name that's referred to from namespace. Like
+// needs, it's first looked up in namespace, and then from the top. A name in the
+// namespace of a config that was loaded with another namespace refers to the name
+// in that namespace.
+func (l *configLoader) lookup(namespace, name string, exists func(string) bool) (string, bool) {
+	for _, fullName := range []string{namespaced(namespace, name), name} {
+		if exists(fullName) {
+			return fullName, true
+		}
+
+		for i := strings.LastIndex(fullName, "/"); i > 0; i = strings.LastIndex(fullName[:i], "/") {
+			if aliased, ok := l.aliases[fullName[:i]]; ok && exists(aliased+fullName[i:]) {
+				return aliased + fullName[i:], true
+			}
+		}
+	}
+	return name, false
+}
+
+// expandTemplates replaces every job that uses a template with its expanded job.
+// The templates are looked up like the needs.
+func (l *configLoader) expandTemplates() {
+	for id, job := range l.jobs {
+		if job.Uses == "" {
+			continue
+		}
+
+		name, ok := l.lookup(l.namespaces[id], job.Uses, func(name string) bool {
+			_, ok := l.templates[name]
+			return ok
+		})
+		if !ok {
+			l.add(job.usesPosition, "%s job uses %s template, but it doesn't exist", id, job.Uses)
+			continue
+		}
+
+		expanded, err := l.templates[name].expand(id, job)
+		if err != nil {
+			l.add(job.usesPosition, "%v", err)
+			continue
+		}
+		l.jobs[id] = expanded
+	}
+}
+
+// resolveNeeds replaces the needs of every job with the IDs of the jobs that they
+// refer to. A need is first looked up in the namespace of the job, and then from
+// the top, so an included config can depend on the jobs of the config that includes it.
+func (l *configLoader) resolveNeeds() {
+	for id, job := range l.jobs {
+		if len(job.Needs) == 0 {
+			continue
+		}
+
+		needs := make([]string, len(job.Needs))
+		for i, need := range job.Needs {
+			var ok bool
+			needs[i], ok = l.lookup(l.namespaces[id], need, func(needID string) bool {
+				_, ok := l.jobs[needID]
+				return ok
+			})
+			if !ok {
+				position := job.position
+				if i < len(job.needsPositions) {
+					position = job.needsPositions[i]
+				}
+				l.add(position, "%s job needs %s job, but it doesn't exist", id, need)
+			}
+		}
+
+		job.Needs = needs
+		l.jobs[id] = job
+	}
+}
+
+// err returns a *ValidationError with the problems sorted by the order of the
+// configs, and by their positions, or nil when there's no problem
+func (l *configLoader) err() error {
+	if len(l.problems) == 0 {
+		return nil
+	}
+
+	order := make(map[string]int)
+	for i, p := range l.paths {
+		if _, ok := order[p]; !ok {
+			order[p] = i
+		}
+	}
+
+	sort.SliceStable(l.problems, func(i, j int) bool {
+		a, b := l.problems[i], l.problems[j]
+		if a.Path != b.Path {
+			return order[a.Path] < order[b.Path]
+		}
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return &ValidationError{Problems: l.problems}
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// writeConfigs writes every config in configs to its path relative to dir
+func writeConfigs(t *testing.T, dir string, configs map[string]string) {
+	for name, content := range configs {
+		p := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// expectProblems fails t unless err is a *ValidationError with exactly the expected problems
+func expectProblems(t *testing.T, err error, expected ...string) {
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected to get a *ValidationError, but got %v", err)
+	}
+
+	var actual []string
+	for _, problem := range validationErr.Problems {
+		actual = append(actual, problem.String())
+	}
+
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected the problems to be\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+}
+
+func TestNewConfigWithIncludes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigs(t, dir, map[string]string{
+		"ci.yaml": `
+include:
+  - shared/setup.yaml
+  - path: lint.yaml
+    namespace: lint
+jobs:
+  build:
+    needs: [setup/install]
+    steps:
+      - run: make`,
+		"shared/setup.yaml": `
+jobs:
+  install:
+    steps:
+      - run: make deps`,
+		"lint.yaml": `
+include:
+  - shared/setup.yaml
+jobs:
+  vet:
+    needs: [setup/install]
+    steps:
+      - run: go vet ./...
+  go:
+    needs: [vet, build]
+    steps:
+      - run: golint ./...`,
+	})
+
+	cfg, err := NewConfig(filepath.Join(dir, "ci.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	for id := range cfg.Jobs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	// lint.yaml includes shared/setup.yaml too, but it's the same setup/install job
+	expected := []string{"build", "lint/go", "lint/vet", "setup/install"}
+	if !reflect.DeepEqual(ids, expected) {
+		t.Fatalf("expected the jobs to be %v, but got %v", expected, ids)
+	}
+
+	if needs := cfg.Jobs["lint/vet"].Needs; !reflect.DeepEqual(needs, []string{"setup/install"}) {
+		t.Fatalf("expected lint/vet to need setup/install, but got %v", needs)
+	}
+
+	if needs := cfg.Jobs["lint/go"].Needs; !reflect.DeepEqual(needs, []string{"lint/vet", "build"}) {
+		t.Fatalf("expected lint/go to need lint/vet and build, but got %v", needs)
+	}
+
+	if needs := cfg.Jobs["build"].Needs; !reflect.DeepEqual(needs, []string{"setup/install"}) {
+		t.Fatalf("expected build to need setup/install, but got %v", needs)
+	}
+
+	if _, err := NewGraph(cfg); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewConfigWithSharedIncludeLoadedInNamespace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// lint.yaml loads shared/setup.yaml first, so the setup job of ci.yaml is lint/setup/install
+	writeConfigs(t, dir, map[string]string{
+		"ci.yaml":           "include: [lint.yaml, shared/setup.yaml]\njobs:\n  build:\n    needs: [setup/install]\n    steps:\n      - run: make\n",
+		"lint.yaml":         "include: [shared/setup.yaml]\njobs:\n  vet:\n    needs: [setup/install]\n    steps:\n      - run: go vet ./...\n",
+		"shared/setup.yaml": "jobs:\n  install:\n    steps:\n      - run: make deps\n",
+	})
+
+	cfg, err := NewConfig(filepath.Join(dir, "ci.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Jobs) != 3 {
+		t.Fatalf("expected to have 3 jobs, but got %+v", cfg.Jobs)
+	}
+
+	for _, id := range []string{"build", "lint/vet"} {
+		if needs := cfg.Jobs[id].Needs; !reflect.DeepEqual(needs, []string{"lint/setup/install"}) {
+			t.Fatalf("expected %s to need lint/setup/install, but got %v", id, needs)
+		}
+	}
+}
+
+func TestNewConfigWithIncludeFromURL(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/ci/main.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("include: [setup.yaml]\njobs:\n  build:\n    needs: [setup/install]\n    steps:\n      - run: make\n"))
+	})
+	mux.HandleFunc("/ci/setup.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("jobs:\n  install:\n    steps:\n      - run: make deps\n"))
+	})
+	testServer := httptest.NewServer(mux)
+	defer testServer.Close()
+
+	cfg, err := NewConfig(testServer.URL + "/ci/main.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := cfg.Jobs["setup/install"]; !ok {
+		t.Fatalf("expected to have setup/install, but got %+v", cfg.Jobs)
+	}
+}
+
+func TestNewConfigWithIncludeCollision(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigs(t, dir, map[string]string{
+		"ci.yaml": `include:
+  - path: a.yaml
+    namespace: shared
+  - path: b.yaml
+    namespace: shared`,
+		"a.yaml": "jobs:\n  setup:\n    steps:\n      - run: make\n",
+		"b.yaml": "jobs:\n  setup:\n    steps:\n      - run: make deps\n",
+	})
+
+	_, err = NewConfig(filepath.Join(dir, "ci.yaml"))
+	expectProblems(t, err, filepath.Join(dir, "b.yaml")+":2:3: shared/setup job is already defined at "+filepath.Join(dir, "a.yaml")+":2:3")
+}
+
+func TestNewConfigWithIncludeCycle(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigs(t, dir, map[string]string{
+		"a.yaml": "include: [b.yaml]\njobs:\n  a:\n    steps:\n      - run: make\n",
+		"b.yaml": "include: [./a.yaml]\njobs:\n  b:\n    steps:\n      - run: make\n",
+	})
+
+	a, b := filepath.Join(dir, "a.yaml"), filepath.Join(dir, "b.yaml")
+	_, err = NewConfig(a)
+	expectProblems(t, err, b+":1:11: detected an include cycle: "+a+" -> "+b+" -> "+a)
+}
+
+func TestNewConfigReportsMissingNeeds(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigs(t, dir, map[string]string{
+		"ci.yaml": `include:
+  - lint.yaml
+  - path: missing.yaml
+    namespace: missing
+jobs:
+  test:
+    needs: [buld]
+    steps:
+      - run: make test`,
+		"lint.yaml": "jobs:\n  go:\n    needs: [vet]\n    steps:\n      - run: golint\n",
+	})
+
+	ci, lint := filepath.Join(dir, "ci.yaml"), filepath.Join(dir, "lint.yaml")
+	_, err = NewConfig(ci)
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) || len(validationErr.Problems) != 3 {
+		t.Fatalf("expected to get 3 problems, but got %v", err)
+	}
+
+	if actual := validationErr.Problems[0].String(); !strings.HasPrefix(actual, ci+":3:5: failed to include missing.yaml: ") {
+		t.Fatalf("expected the missing include to be reported, but got \"%s\"", actual)
+	}
+
+	expected := []string{
+		ci + ":7:13: test job needs buld job, but it doesn't exist",
+		lint + ":3:13: lint/go job needs vet job, but it doesn't exist",
+	}
+	for i, problem := range validationErr.Problems[1:] {
+		if problem.String() != expected[i] {
+			t.Fatalf("expected the problem to be \"%s\", but got \"%s\"", expected[i], problem)
+		}
+	}
+}
+
+func TestResolveInclude(t *testing.T) {
+	tests := []struct {
+		parent, include string
+		expected        string
+	}{
+		{"ci.yaml", "lint.yaml", "lint.yaml"},
+		{"ci/main.yaml", "../shared/setup.yaml", "shared/setup.yaml"},
+		{"ci/main.yaml", "/etc/setup.yaml", "/etc/setup.yaml"},
+		{"ci/main.yaml", "https://example.com/setup.yaml", "https://example.com/setup.yaml"},
+		{"https://example.com/ci/main.yaml", "setup.yaml", "https://example.com/ci/setup.yaml"},
+		{"https://example.com/ci/main.yaml", "../shared/setup.yaml", "https://example.com/shared/setup.yaml"},
+	}
+
+	for _, test := range tests {
+		if actual := resolveInclude(test.parent, test.include); actual != test.expected {
+			t.Fatalf("expected %s included by %s to be %s, but got %s", test.include, test.parent, test.expected, actual)
+		}
+	}
+}
+
+func TestDefaultNamespace(t *testing.T) {
+	tests := []struct {
+		path     string
+		expected string
+	}{
+		{"lint.yaml", "lint"},
+		{"shared/setup.yml", "setup"},
+		{"https://example.com/ci/deploy.yaml?ref=main", "deploy"},
+	}
+
+	for _, test := range tests {
+		if actual := defaultNamespace(test.path); actual != test.expected {
+			t.Fatalf("expected the namespace of %s to be %s, but got %s", test.path, test.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// jobState is what's remembered about a job with inputs after it succeeded
+type jobState struct {
+	// Hash is the hash of the job definition and its inputs
+	Hash string `json:"hash"`
+	// Outputs are the outputs of the job, so that they can be passed to its dependents
+	// when the job is skipped for being up to date
+	Outputs map[string]string `json:"outputs,omitempty"`
+}
+
+// stateStore keeps a jobState for every job of a config in a directory
+type stateStore struct {
+	dir string
+	// config is the path of the config, so that the jobs with the same ID from
+	// different configs don't share their states
+	config string
+}
+
+func (s stateStore) path(id string) string {
+	sum := sha256.Sum256([]byte(s.config + "\x00" + id))
+	return filepath.Join(s.dir, "jobs", hex.EncodeToString(sum[:8])+".json")
+}
+
+// load returns the state of job id. If there's no valid state, false will be returned.
+func (s stateStore) load(id string) (jobState, bool) {
+	var state jobState
+	data, err := ioutil.ReadFile(s.path(id))
+	if err != nil {
+		return state, false
+	}
+	return state, json.Unmarshal(data, &state) == nil
+}
+
+func (s stateStore) save(id string, state jobState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	p := s.path(id)
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p, data, 0644)
+}
+
+func (s stateStore) remove(id string) error {
+	err := os.Remove(s.path(id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// hashJob hashes the definition of n, the environments from its dependencies, and
+// the content of every file that matches its inputs
+func hashJob(n *Node, needsEnv Env) (string, error) {
+	h := sha256.New()
+	definition, err := json.Marshal(struct {
+		ID     string
+		Job    Job
+		Matrix map[string]string
+		Needs  []string
+	}{n.ID, n.Job, n.Matrix, needsEnv.Encode()})
+	if err != nil {
+		return "", err
+	}
+	h.Write(definition)
+
+	files, err := expandGlobs(n.Job.Inputs)
+	if err != nil {
+		return "", err
+	}
+
+	for _, file := range files {
+		fmt.Fprintf(h, "\x00%s\x00", file)
+		f, err := os.Open(file)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// outputsExist returns true when every path exists
+func outputsExist(paths []string) bool {
+	for _, p := range paths {
+		if _, err := os.Stat(p); err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// expandGlobs returns every file that matches one of patterns in sorted order.
+// Besides the filepath.Match syntax, "**" matches any number of directories.
+// A pattern that matches a directory matches every file in it.
+func expandGlobs(patterns []string) ([]string, error) {
+	matched := make(map[string]struct{})
+	for _, pattern := range patterns {
+		base, segments, err := splitGlob(pattern)
+		if err != nil {
+			return nil, err
+		}
+
+		err = filepath.Walk(base, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				if os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+
+			if !info.IsDir() && matchGlobSegments(segments, p) {
+				matched[p] = struct{}{}
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	files := make([]string, 0, len(matched))
+	for file := range matched {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// splitGlob splits pattern into its segments, and finds the deepest directory,
+// or file, that doesn't have a glob. Only that base needs to be walked to find
+// every match.
+func splitGlob(pattern string) (string, []string, error) {
+	segments := strings.Split(filepath.ToSlash(filepath.Clean(pattern)), "/")
+	for _, segment := range segments {
+		if _, err := path.Match(segment, ""); err != nil {
+			return "", nil, fmt.Errorf("invalid glob %s: %w", pattern, err)
+		}
+	}
+
+	var i int
+	for i < len(segments) && !strings.ContainsAny(segments[i], `*?[\`) {
+		i++
+	}
+
+	base := strings.Join(segments[:i], "/")
+	if i == 1 && segments[0] == "" {
+		base = "/"
+	} else if i == 0 {
+		base = "."
+	}
+	return filepath.FromSlash(base), segments, nil
+}
+
+// matchGlob returns true when p is matched by pattern, or p is in a directory
+// that's matched by pattern
+func matchGlob(pattern, p string) bool {
+	_, segments, err := splitGlob(pattern)
+	return err == nil && matchGlobSegments(segments, p)
+}
+
+func matchGlobSegments(segments []string, p string) bool {
+	pathSegments := strings.Split(filepath.ToSlash(filepath.Clean(p)), "/")
+	for i := 1; i <= len(pathSegments); i++ {
+		if matchSegments(segments, pathSegments[:i]) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchSegments matches path segments against pattern segments, where a "**"
+// pattern segment matches any number of path segments
+func matchSegments(pattern, segments []string) bool {
+	if len(pattern) == 0 {
+		return len(segments) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(pattern[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if len(segments) == 0 {
+		return false
+	}
+
+	ok, _ := path.Match(pattern[0], segments[0])
+	return ok && matchSegments(pattern[1:], segments[1:])
+}
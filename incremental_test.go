@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExpandGlobs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, name := range []string{"a.go", "b.txt", "sub/c.go", "sub/deep/d.go", "assets/e.png"} {
+		p := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		if err := ioutil.WriteFile(p, []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := expandGlobs([]string{
+		filepath.Join(dir, "**", "*.go"),
+		filepath.Join(dir, "assets"),
+		filepath.Join(dir, "missing", "*"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var rel []string
+	for _, file := range files {
+		r, _ := filepath.Rel(dir, file)
+		rel = append(rel, filepath.ToSlash(r))
+	}
+
+	expected := "a.go,assets/e.png,sub/c.go,sub/deep/d.go"
+	if actual := strings.Join(rel, ","); actual != expected {
+		t.Fatalf("expected the files to be %s, but got %s", expected, actual)
+	}
+}
+
+func TestExpandGlobsInvalid(t *testing.T) {
+	if _, err := expandGlobs([]string{"[a"}); err == nil {
+		t.Fatal("expected to get an error due to an invalid glob")
+	}
+}
+
+func TestMatchSegments(t *testing.T) {
+	tests := []struct {
+		pattern  string
+		path     string
+		expected bool
+	}{
+		{"**", "a/b/c", true},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/b/b/c", true},
+		{"a/*/c", "a/b/b/c", false},
+		{"*.go", "a/b.go", false},
+	}
+
+	for _, test := range tests {
+		actual := matchSegments(strings.Split(test.pattern, "/"), strings.Split(test.path, "/"))
+		if actual != test.expected {
+			t.Fatalf("expected %s matching %s to be %t, but got %t", test.pattern, test.path, test.expected, actual)
+		}
+	}
+}
+
+func TestStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	store := stateStore{dir: dir, config: "/ci.yaml"}
+	if _, ok := store.load("job1"); ok {
+		t.Fatal("expected to not have a state")
+	}
+
+	err = store.save("job1", jobState{Hash: "abc", Outputs: map[string]string{"version": "1"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := (stateStore{dir: dir, config: "/release.yaml"}).load("job1"); ok {
+		t.Fatal("expected job1 of another config to not have a state")
+	}
+
+	state, ok := store.load("job1")
+	if !ok || state.Hash != "abc" || state.Outputs["version"] != "1" {
+		t.Fatalf("expected to load the saved state, but got %+v", state)
+	}
+
+	if err := store.remove("job1"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := store.load("job1"); ok {
+		t.Fatal("expected the state to be removed")
+	}
+}
+
+func TestRunWithInputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	input := filepath.Join(dir, "input.txt")
+	output := filepath.Join(dir, "output.txt")
+	ioutil.WriteFile(input, []byte("v1"), 0644)
+	cfg := Config{
+		Jobs: map[string]Job{
+			"gen": {
+				Inputs:  []string{input},
+				Outputs: []string{output},
+				Steps: []Step{{Run: "echo gen && cp " + input + " " + output +
+					` && echo "version=$(cat ` + input + `)" >> "$GOTOPUS_OUTPUT"`}},
+			},
+			"use": {Needs: []string{"gen"}, Steps: []Step{{Run: "echo use $GOTOPUS_NEEDS_GEN_VERSION"}}},
+		},
+	}
+
+	run := func() string {
+		var stdoutBuf, stderrBuf syncBuffer
+		err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf, StateDir: filepath.Join(dir, ".gotopus")})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return stdoutBuf.String()
+	}
+
+	if out := run(); out != "gen\nuse v1\n" {
+		t.Fatalf("expected gen to run the first time, but got \"%s\"", out)
+	}
+
+	if out := run(); out != "use v1\n" {
+		t.Fatalf("expected gen to be up to date, but got \"%s\"", out)
+	}
+
+	ioutil.WriteFile(input, []byte("v2"), 0644)
+	if out := run(); out != "gen\nuse v2\n" {
+		t.Fatalf("expected gen to run after its input changed, but got \"%s\"", out)
+	}
+
+	os.Remove(output)
+	if out := run(); out != "gen\nuse v2\n" {
+		t.Fatalf("expected gen to run after its output was removed, but got \"%s\"", out)
+	}
+}
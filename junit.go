@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// junitStderrTailSize is how many bytes from the end of stderr are kept for
+// every step in the JUnit report
+const junitStderrTailSize = 4096
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     string           `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     string          `xml:"time,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr,omitempty"`
+}
+
+// JUnitReport collects the results of runs into a JUnit XML report, where every
+// job is a testsuite and every step is a testcase. It's safe to add results from
+// multiple runs concurrently.
+type JUnitReport struct {
+	mu     sync.Mutex
+	suites []junitTestSuite
+	time   time.Duration
+}
+
+// Add adds a testsuite for every job in the graph from root. Jobs and steps that
+// don't have a result, or weren't reached, are reported as skipped. When config
+// isn't empty, it prefixes the names of the testsuites, e.g. ci/build.
+func (r *JUnitReport) Add(config string, root *Node, results []ResultNode) {
+	resultByNode := make(map[*Node]ResultNode, len(results))
+	for _, result := range results {
+		resultByNode[result.Node] = result
+	}
+
+	var suites []junitTestSuite
+	for _, node := range root.Descendants() {
+		result, ok := resultByNode[node]
+		suites = append(suites, newJUnitTestSuite(namespaced(config, node.ID), node, result, ok))
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.suites = append(r.suites, suites...)
+}
+
+// SetTime sets how long the runs took altogether. The runs can be concurrent, so it
+// isn't the sum of their times.
+func (r *JUnitReport) SetTime(d time.Duration) {
+	r.mu.Lock()
+	r.time = d
+	r.mu.Unlock()
+}
+
+func newJUnitTestSuite(id string, n *Node, result ResultNode, ran bool) junitTestSuite {
+	suite := junitTestSuite{Name: id, Time: junitTime(result.Report.Duration)}
+	var failed bool
+	for i, step := range n.Job.Steps {
+		name := step.Name
+		if name == "" {
+			name = fmt.Sprintf("#%d", i+1)
+		}
+
+		testCase := junitTestCase{Name: name, ClassName: id, Time: junitTime(0)}
+		if i < len(result.Report.Steps) {
+			report := result.Report.Steps[i]
+			testCase.Time = junitTime(report.Duration)
+			if report.Skipped {
+				message := "its if expression was false"
+				if step.If == "" {
+					message = "a previous step failed"
+				}
+				testCase.Skipped = &junitSkipped{Message: message}
+				suite.Skipped++
+			} else if report.Err != nil {
+				// The job error comes from the first failed step, and describes it the best
+				message := report.Err.Error()
+				if result.Err != nil && !failed {
+					message = result.Err.Error()
+				}
+				failed = true
+
+				testCase.Failure = &junitFailure{
+					Message: message,
+					Type:    fmt.Sprintf("exit code %d", report.ExitCode),
+					Text:    report.StderrTail,
+				}
+				suite.Failures++
+			}
+		} else if ran && result.Err != nil && !failed {
+			// The job failed before its steps ran, e.g. its if expression couldn't be evaluated
+			failed = true
+			testCase.Failure = &junitFailure{Message: result.Err.Error(), Type: "error"}
+			suite.Failures++
+		} else {
+			message := "a previous step failed"
+			if !ran {
+				message = "the job didn't run"
+			}
+			testCase.Skipped = &junitSkipped{Message: message}
+			suite.Skipped++
+		}
+
+		suite.Cases = append(suite.Cases, testCase)
+		suite.Tests++
+	}
+	return suite
+}
+
+// Write writes the report as XML to w
+func (r *JUnitReport) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	report := junitTestSuites{Suites: r.suites, Time: junitTime(r.time)}
+	for _, suite := range r.suites {
+		report.Tests += suite.Tests
+		report.Failures += suite.Failures
+		report.Skipped += suite.Skipped
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(report); err != nil {
+		return err
+	}
+
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteFile writes the report as XML to a file at path
+func (r *JUnitReport) WriteFile(path string) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := r.Write(f); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// junitTime formats d as seconds like JUnit does
+func junitTime(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
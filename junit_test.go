@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJUnitReport(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{{Name: "build", Run: "echo ok"}}},
+			"job2": {Needs: []string{"job1"}, Steps: []Step{
+				{Name: "test", Run: "echo broken >&2 && exit 3"},
+				{Name: "cleanup", Run: "echo cleanup"},
+			}},
+			"job3": {Needs: []string{"job2"}, Steps: []Step{{Run: "echo job3"}}},
+		},
+	}
+
+	report := &JUnitReport{}
+	var stdoutBuf, stderrBuf syncBuffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf, JUnit: report})
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	var buf bytes.Buffer
+	if err := report.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+
+	if suites.Tests != 4 || suites.Failures != 1 || suites.Skipped != 2 {
+		t.Fatalf("expected 4 tests, 1 failure and 2 skipped, but got %d, %d and %d", suites.Tests, suites.Failures, suites.Skipped)
+	}
+
+	if len(suites.Suites) != 3 {
+		t.Fatalf("expected to get 3 testsuites, but got %d", len(suites.Suites))
+	}
+
+	job2 := suites.Suites[1]
+	if job2.Name != "job2" || len(job2.Cases) != 2 {
+		t.Fatalf("expected job2 to have 2 testcases, but got %+v", job2)
+	}
+
+	failure := job2.Cases[0].Failure
+	if failure == nil {
+		t.Fatal("expected the test step to fail")
+	}
+
+	if failure.Type != "exit code 3" {
+		t.Fatalf("expected the failure type to be \"exit code 3\", but got \"%s\"", failure.Type)
+	}
+
+	if failure.Text != "broken\n" {
+		t.Fatalf("expected the failure to contain stderr, but got \"%s\"", failure.Text)
+	}
+
+	if !strings.Contains(failure.Message, "exit status 3") {
+		t.Fatalf("expected the failure message to contain the error, but got \"%s\"", failure.Message)
+	}
+
+	if job2.Cases[1].Skipped == nil || job2.Cases[1].Skipped.Message != "a previous step failed" {
+		t.Fatalf("expected the cleanup step to be skipped, but got %+v", job2.Cases[1])
+	}
+
+	job3 := suites.Suites[2]
+	if job3.Cases[0].Name != "#1" || job3.Cases[0].Skipped == nil || job3.Cases[0].Skipped.Message != "the job didn't run" {
+		t.Fatalf("expected job3 to be skipped, but got %+v", job3.Cases[0])
+	}
+}
+
+func TestJUnitReportWithJobFailingBeforeRun(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(stateDir)
+
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Inputs: []string{"["}, Steps: []Step{{Name: "build", Run: "echo job1"}}},
+		},
+	}
+
+	report := &JUnitReport{}
+	var stdoutBuf syncBuffer
+	if err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, StateDir: stateDir, JUnit: report}); err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	var buf bytes.Buffer
+	if err := report.Write(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var suites junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &suites); err != nil {
+		t.Fatal(err)
+	}
+
+	if suites.Failures != 1 || suites.Skipped != 0 {
+		t.Fatalf("expected 1 failure and 0 skipped, but got %d and %d", suites.Failures, suites.Skipped)
+	}
+
+	failure := suites.Suites[0].Cases[0].Failure
+	if failure == nil || !strings.Contains(failure.Message, "failed to hash the inputs of job1 job") {
+		t.Fatalf("expected job1 to fail because of its inputs, but got %+v", suites.Suites[0].Cases[0])
+	}
+}
+
+func TestJUnitReportWriteFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	report := &JUnitReport{}
+	report.Add("", NewNode(Job{}, "root"), nil)
+	report.SetTime(time.Millisecond * 1500)
+	path := filepath.Join(dir, "report.xml")
+	if err := report.WriteFile(path); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.HasPrefix(string(data), xml.Header+"<testsuites tests=\"0\"") {
+		t.Fatalf("expected to get an empty report, but got \"%s\"", string(data))
+	}
+
+	if !strings.Contains(string(data), "time=\"1.500\"") {
+		t.Fatalf("expected the report to take 1.500 seconds, but got \"%s\"", string(data))
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	buf := &tailBuffer{size: 4}
+	buf.Write([]byte("12"))
+	buf.Write([]byte("3456"))
+	if string(buf.buf) != "3456" {
+		t.Fatalf("expected to keep \"3456\", but got \"%s\"", string(buf.buf))
+	}
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+// IsEmpty returns true when m doesn't expand a job
+func (m Matrix) IsEmpty() bool {
+	return len(m.Values) == 0 && len(m.Include) == 0
+}
+
+// Combinations expands m into every combination of its values, like GitHub Actions
+// does. The combinations are ordered by the sorted variable names, and the values
+// keep the order from the config. Exclusions are applied before inclusions.
+func (m Matrix) Combinations() []map[string]string {
+	keys := make([]string, 0, len(m.Values))
+	for key := range m.Values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var combinations []map[string]string
+	if len(keys) > 0 {
+		combinations = []map[string]string{{}}
+	}
+
+	for _, key := range keys {
+		var expanded []map[string]string
+		for _, combination := range combinations {
+			for _, value := range m.Values[key] {
+				next := make(map[string]string, len(combination)+1)
+				for k, v := range combination {
+					next[k] = v
+				}
+				next[key] = value
+				expanded = append(expanded, next)
+			}
+		}
+		combinations = expanded
+	}
+
+	var filtered []map[string]string
+	for _, combination := range combinations {
+		var excluded bool
+		for _, exclude := range m.Exclude {
+			if matchCombination(combination, exclude) {
+				excluded = true
+				break
+			}
+		}
+
+		if !excluded {
+			filtered = append(filtered, combination)
+		}
+	}
+	combinations = filtered
+
+	for _, include := range m.Include {
+		// Only the matrix variables decide whether include matches, the rest are added
+		original := make(map[string]string)
+		for k, v := range include {
+			if _, ok := m.Values[k]; ok {
+				original[k] = v
+			}
+		}
+
+		var matched bool
+		for _, combination := range combinations {
+			if !matchCombination(combination, original) {
+				continue
+			}
+
+			matched = true
+			for k, v := range include {
+				combination[k] = v
+			}
+		}
+
+		if !matched {
+			combination := make(map[string]string, len(include))
+			for k, v := range include {
+				combination[k] = v
+			}
+			combinations = append(combinations, combination)
+		}
+	}
+	return combinations
+}
+
+// matchCombination returns true when combination has every value from values
+func matchCombination(combination, values map[string]string) bool {
+	for k, v := range values {
+		if combination[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// matrixID creates a node ID for the combination of job jobID, e.g. test(go=1.20,os=linux)
+func matrixID(jobID string, combination map[string]string) string {
+	keys := make([]string, 0, len(combination))
+	for key := range combination {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	values := make([]string, len(keys))
+	for i, key := range keys {
+		values[i] = fmt.Sprintf("%s=%s", key, combination[key])
+	}
+	return fmt.Sprintf("%s(%s)", jobID, strings.Join(values, ","))
+}
+
+// envName converts name to an environment variable name by uppercasing it and
+// replacing every run of characters that aren't letters or digits with a single
+// "_", e.g. test(go=1.20) becomes TEST_GO_1_20
+func envName(name string) string {
+	fields := strings.FieldsFunc(name, func(r rune) bool {
+		return r > unicode.MaxASCII || !(unicode.IsLetter(r) || unicode.IsDigit(r))
+	})
+	return strings.ToUpper(strings.Join(fields, "_"))
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMatrixCombinations(t *testing.T) {
+	matrix := Matrix{
+		Values: map[string][]string{
+			"os": {"linux", "darwin"},
+			"go": {"1.20", "1.21"},
+		},
+		Exclude: []map[string]string{
+			{"go": "1.20", "os": "darwin"},
+		},
+		Include: []map[string]string{
+			{"go": "1.21", "experimental": "true"},
+			{"go": "1.22", "os": "windows"},
+		},
+	}
+
+	expected := []map[string]string{
+		{"go": "1.20", "os": "linux"},
+		{"go": "1.21", "os": "linux", "experimental": "true"},
+		{"go": "1.21", "os": "darwin", "experimental": "true"},
+		{"go": "1.22", "os": "windows"},
+	}
+
+	actual := matrix.Combinations()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected the combinations to be %v, but got %v", expected, actual)
+	}
+}
+
+func TestMatrixCombinationsOnlyInclude(t *testing.T) {
+	matrix := Matrix{Include: []map[string]string{{"os": "linux"}}}
+	expected := []map[string]string{{"os": "linux"}}
+	actual := matrix.Combinations()
+	if !reflect.DeepEqual(actual, expected) {
+		t.Fatalf("expected the combinations to be %v, but got %v", expected, actual)
+	}
+}
+
+func TestMatrixID(t *testing.T) {
+	id := matrixID("test", map[string]string{"os": "linux", "go": "1.20"})
+	if id != "test(go=1.20,os=linux)" {
+		t.Fatalf("expected the ID to be \"test(go=1.20,os=linux)\", but got \"%s\"", id)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	name := envName("go-version.x")
+	if name != "GO_VERSION_X" {
+		t.Fatalf("expected the name to be \"GO_VERSION_X\", but got \"%s\"", name)
+	}
+
+	name = envName("test(go=1.20)")
+	if name != "TEST_GO_1_20" {
+		t.Fatalf("expected the name to be \"TEST_GO_1_20\", but got \"%s\"", name)
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+)
+
+const (
+	// ModeSequential runs the configs one after another
+	ModeSequential = "sequential"
+	// ModeConcurrent runs the configs at the same time, and they share the workers
+	ModeConcurrent = "concurrent"
+	// ModeMerged runs the jobs of all of the configs as one graph, where the IDs
+	// of the jobs are prefixed by their configs
+	ModeMerged = "merged"
+)
+
+// errConfigSkipped is the result of a config that didn't run, because a config
+// before it failed
+var errConfigSkipped = errors.New("skipped, since a previous config failed")
+
+// mergeConfigs loads the configs at paths, along with their includes, as one config.
+// The IDs of the jobs are prefixed by the file names of their configs without the
+// extension, e.g. the build job of ci.yaml is ci/build.
+func mergeConfigs(paths []string) (Config, error) {
+	l := newConfigLoader()
+	var merged Config
+	prefixes := make(map[string]string)
+	for _, path := range paths {
+		prefix := defaultNamespace(path)
+		if !jobIDPattern.MatchString(prefix) {
+			return merged, fmt.Errorf("can't use %q as the prefix of the jobs of %s", prefix, path)
+		}
+
+		if other, ok := prefixes[prefix]; ok {
+			return merged, fmt.Errorf("can't merge %s and %s, since the jobs of both would be prefixed with %s/", other, path, prefix)
+		}
+		prefixes[prefix] = path
+
+		l.loaded[loadedKey(path, "")] = prefix
+		l.loaded[loadedKey(path, prefix)] = prefix
+		cfg, err := l.load(path, prefix, nil)
+		if err != nil {
+			return merged, err
+		}
+
+		if merged.Version == "" {
+			merged.Version = cfg.Version
+		}
+
+		if merged.path != "" {
+			merged.path += "\x00"
+		}
+		merged.path += canonicalConfigPath(path)
+	}
+
+	l.expandTemplates()
+	l.resolveNeeds()
+	merged.Jobs = l.jobs
+	merged.Templates = l.templates
+	return merged, l.err()
+}
+
+// runConfigs runs configs with opts in mode, and returns the result of every config
+// in the same order. states are the run states of the configs, or nil. In
+// ModeSequential, the configs after a failed config are skipped unless
+// opts.KeepGoing is set. In ModeConcurrent, the file names of the configs without
+// their extensions tell their jobs apart, e.g. ci/build. Merged configs are run
+// like a single config.
+func runConfigs(mode string, configs []Config, states []*RunState, opts RunOptions) []error {
+	errs := make([]error, len(configs))
+	optsOf := func(i int) RunOptions {
+		configOpts := opts
+		if states != nil {
+			configOpts.State = states[i]
+		}
+		return configOpts
+	}
+
+	// The plans would get mixed up in the output if they were written concurrently
+	if mode != ModeConcurrent || opts.DryRun {
+		for i, cfg := range configs {
+			errs[i] = RunWithOptions(cfg, optsOf(i))
+			if errs[i] != nil && !opts.KeepGoing {
+				for j := i + 1; j < len(configs); j++ {
+					errs[j] = errConfigSkipped
+				}
+				break
+			}
+		}
+		return errs
+	}
+
+	poolCtx, cancelPool := context.WithCancel(context.Background())
+	defer cancelPool()
+	if opts.Pool == nil {
+		opts.Pool = PoolStart(poolCtx, opts.MaxWorkers)
+	}
+
+	var wg sync.WaitGroup
+	for i, cfg := range configs {
+		configOpts := optsOf(i)
+		if cfg.path != "" {
+			configOpts.ConfigName = defaultNamespace(cfg.path)
+		}
+
+		wg.Add(1)
+		go func(i int, cfg Config, configOpts RunOptions) {
+			defer wg.Done()
+			errs[i] = RunWithOptions(cfg, configOpts)
+		}(i, cfg, configOpts)
+	}
+	wg.Wait()
+	return errs
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMergeConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigs(t, dir, map[string]string{
+		"backend.yaml":  "jobs:\n  build:\n    steps:\n      - run: make\n",
+		"frontend.yaml": "jobs:\n  build:\n    steps:\n      - run: npm run build\n  test:\n    needs: [build, backend/build]\n    steps:\n      - run: npm test\n",
+	})
+
+	cfg, err := mergeConfigs([]string{filepath.Join(dir, "backend.yaml"), filepath.Join(dir, "frontend.yaml")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Jobs) != 3 {
+		t.Fatalf("expected to have 3 jobs, but got %+v", cfg.Jobs)
+	}
+
+	if needs := cfg.Jobs["frontend/test"].Needs; !reflect.DeepEqual(needs, []string{"frontend/build", "backend/build"}) {
+		t.Fatalf("expected frontend/test to need frontend/build and backend/build, but got %v", needs)
+	}
+}
+
+func TestMergeConfigsWithSamePrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeConfigs(t, dir, map[string]string{
+		"a/ci.yaml": "jobs:\n  build:\n    steps:\n      - run: make\n",
+		"b/ci.yml":  "jobs:\n  build:\n    steps:\n      - run: make\n",
+	})
+
+	_, err = mergeConfigs([]string{filepath.Join(dir, "a", "ci.yaml"), filepath.Join(dir, "b", "ci.yml")})
+	if err == nil || !strings.Contains(err.Error(), "since the jobs of both would be prefixed with ci/") {
+		t.Fatalf("expected to get an error due to the same prefix, but got %v", err)
+	}
+}
+
+func TestRunConfigsSequential(t *testing.T) {
+	failing := Config{Jobs: map[string]Job{"job": {Steps: []Step{{Run: "exit 1"}}}}}
+	passing := Config{Jobs: map[string]Job{"job": {Steps: []Step{{Run: "echo passed"}}}}}
+
+	var stdoutBuf syncBuffer
+	errs := runConfigs(ModeSequential, []Config{failing, passing}, nil, RunOptions{Stdout: &stdoutBuf})
+	if errs[0] == nil || errs[1] != errConfigSkipped {
+		t.Fatalf("expected the second config to be skipped, but got %v", errs)
+	}
+
+	errs = runConfigs(ModeSequential, []Config{failing, passing}, nil, RunOptions{Stdout: &stdoutBuf, KeepGoing: true})
+	if errs[0] == nil || errs[1] != nil {
+		t.Fatalf("expected the second config to keep going, but got %v", errs)
+	}
+
+	if actual := stdoutBuf.String(); actual != "passed\n" {
+		t.Fatalf("expected the second config to run once, but got \"%s\"", actual)
+	}
+}
+
+func TestRunConfigsConcurrent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The configs wait for each other, so they only pass when they run at the same time
+	ping, pong := filepath.Join(dir, "ping"), filepath.Join(dir, "pong")
+	configs := []Config{
+		{Jobs: map[string]Job{"job": {
+			Timeout: time.Second * 5,
+			Steps:   []Step{{Run: "touch " + ping + "; while [ ! -e " + pong + " ]; do sleep 0.01; done"}},
+		}}},
+		{Jobs: map[string]Job{"job": {
+			Timeout: time.Second * 5,
+			Steps:   []Step{{Run: "touch " + pong + "; while [ ! -e " + ping + " ]; do sleep 0.01; done"}},
+		}}},
+		{Jobs: map[string]Job{"job": {Steps: []Step{{Run: "exit 1"}}}}},
+	}
+
+	var stdoutBuf syncBuffer
+	errs := runConfigs(ModeConcurrent, configs, nil, RunOptions{Stdout: &stdoutBuf, MaxWorkers: 3})
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("expected the configs to run concurrently, but got %v", errs)
+	}
+
+	if errs[2] == nil {
+		t.Fatal("expected the failing config to be reported")
+	}
+}
+
+func TestRunConfigsConcurrentWithConfigNames(t *testing.T) {
+	configs := []Config{
+		{Jobs: map[string]Job{"build": {Steps: []Step{{Run: "echo backend"}}}}, path: "/ci/backend.yaml"},
+		{Jobs: map[string]Job{"build": {Steps: []Step{{Run: "echo frontend"}}}}, path: "/ci/frontend.yaml"},
+	}
+
+	var stdoutBuf, eventsBuf, junitBuf syncBuffer
+	report := &JUnitReport{}
+	opts := RunOptions{Stdout: &stdoutBuf, Output: OutputPrefixed, Events: NewEventLog(&eventsBuf), JUnit: report}
+	for _, err := range runConfigs(ModeConcurrent, configs, nil, opts) {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, line := range []string{"[backend/build] backend\n", "[frontend/build] frontend\n"} {
+		if !strings.Contains(stdoutBuf.String(), line) {
+			t.Fatalf("expected the output to contain \"%s\", but got \"%s\"", line, stdoutBuf.String())
+		}
+	}
+
+	for _, event := range []string{`"job":"build","config":"backend"`, `"job":"build","config":"frontend"`} {
+		if !strings.Contains(eventsBuf.String(), event) {
+			t.Fatalf("expected the events to contain %s, but got %s", event, eventsBuf.String())
+		}
+	}
+
+	if err := report.Write(&junitBuf); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, suite := range []string{`name="backend/build"`, `name="frontend/build"`} {
+		if !strings.Contains(junitBuf.String(), suite) {
+			t.Fatalf("expected the report to contain %s, but got %s", suite, junitBuf.String())
+		}
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// OutputStream lets every job write to stdout and stderr directly
+	OutputStream = "stream"
+	// OutputPrefixed prefixes every line with the job ID, and guarantees that
+	// lines from different jobs never get mixed up
+	OutputPrefixed = "prefixed"
+	// OutputGrouped captures the output of every job, and writes it as a single
+	// block once the job has finished
+	OutputGrouped = "grouped"
+)
+
+// spillThreshold is how much output of a job can be kept in memory in the grouped
+// output mode. After that, the output will be spilled to a temporary file.
+const spillThreshold = 1024 * 1024
+
+// maxLineSize limits how much a line can be buffered. A longer line will be
+// broken into multiple lines.
+const maxLineSize = 64 * 1024
+
+const colorReset = "\x1b[0m"
+
+var outputColors = []string{
+	"\x1b[36m", // cyan
+	"\x1b[32m", // green
+	"\x1b[33m", // yellow
+	"\x1b[35m", // magenta
+	"\x1b[34m", // blue
+	"\x1b[31m", // red
+}
+
+// stepSetter is implemented by writers that want to know which step is running
+type stepSetter interface {
+	SetStep(name string)
+}
+
+// setStep notifies w about the running step if w wants to know about it
+func setStep(w io.Writer, name string) {
+	if s, ok := w.(stepSetter); ok {
+		s.SetStep(name)
+	}
+}
+
+// lineFlusher is implemented by writers that buffer the output until there's a whole line
+type lineFlusher interface {
+	Flush() error
+}
+
+// flushLine writes the partial line that w still buffers, so that it isn't continued
+// by the output of the next step
+func flushLine(w io.Writer) error {
+	if f, ok := w.(lineFlusher); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// jobOutput is where a job writes its output
+type jobOutput struct {
+	Stdout io.Writer
+	Stderr io.Writer
+	// Finish flushes whatever is still buffered. It must be called once the result
+	// of the job has arrived.
+	Finish func(ResultNode) error
+}
+
+// outputMux multiplexes the output from concurrent jobs into shared stdout and stderr
+type outputMux struct {
+	mu         sync.Mutex
+	mode       string
+	stdout     io.Writer
+	stderr     io.Writer
+	prefixStep bool
+	colors     map[*Node]string
+	// config prefixes the job IDs, see RunOptions.ConfigName
+	config string
+}
+
+// newOutputMux creates an outputMux based on opts for every node in nodes
+func newOutputMux(opts RunOptions, nodes []*Node) (*outputMux, error) {
+	mode := opts.Output
+	if mode == "" {
+		mode = OutputStream
+	}
+
+	if mode != OutputStream && mode != OutputPrefixed && mode != OutputGrouped {
+		return nil, fmt.Errorf("unknown output mode: %s", mode)
+	}
+
+	stderr := opts.Stderr
+	if stderr == nil {
+		stderr = opts.Stdout
+	}
+
+	mux := outputMux{
+		mode:       mode,
+		stdout:     opts.Stdout,
+		stderr:     stderr,
+		prefixStep: opts.PrefixStep,
+		colors:     make(map[*Node]string),
+		config:     opts.ConfigName,
+	}
+
+	if opts.Color {
+		for i, node := range nodes {
+			mux.colors[node] = outputColors[i%len(outputColors)]
+		}
+	}
+	return &mux, nil
+}
+
+// job returns the output that n should write to
+func (m *outputMux) job(n *Node) jobOutput {
+	switch m.mode {
+	case OutputStream:
+		return jobOutput{
+			Stdout: m.stdout,
+			Stderr: m.stderr,
+			Finish: func(ResultNode) error { return nil },
+		}
+	case OutputGrouped:
+		// stdout and stderr share the same buffer to keep their order
+		buf := &spillBuffer{limit: spillThreshold}
+		return jobOutput{
+			Stdout: buf,
+			Stderr: buf,
+			Finish: func(result ResultNode) error {
+				defer buf.Close()
+				return m.writeGroup(result, buf)
+			},
+		}
+	}
+
+	prefix := &linePrefix{mux: m, node: n}
+	stdout := &lineWriter{prefix: prefix, out: m.stdout}
+	stderr := &lineWriter{prefix: prefix, out: m.stderr}
+	return jobOutput{
+		Stdout: stdout,
+		Stderr: stderr,
+		Finish: func(ResultNode) error {
+			if err := stdout.Flush(); err != nil {
+				return err
+			}
+			return stderr.Flush()
+		},
+	}
+}
+
+// writeGroup writes the captured output from buf as a contiguous block surrounded
+// by a header and a footer
+func (m *outputMux) writeGroup(result ResultNode, buf *spillBuffer) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	id := namespaced(m.config, result.ID)
+	label := id
+	if result.Job.Name != "" {
+		label = fmt.Sprintf("%s (%s)", id, result.Job.Name)
+	}
+
+	status := "succeeded"
+	if result.Err != nil {
+		status = fmt.Sprintf("failed: %v", result.Err)
+	}
+
+	if _, err := fmt.Fprintf(m.stdout, "==> %s\n", label); err != nil {
+		return err
+	}
+
+	if _, err := buf.WriteTo(m.stdout); err != nil {
+		return err
+	}
+
+	_, err := fmt.Fprintf(m.stdout, "<== %s %s in %s\n", id, status, result.Report.Duration.Round(time.Millisecond))
+	return err
+}
+
+// linePrefix is shared by the stdout and stderr of a job
+type linePrefix struct {
+	mux  *outputMux
+	node *Node
+	step string
+}
+
+// SetStep sets the step name that will be used in the prefix
+func (p *linePrefix) SetStep(name string) {
+	p.mux.mu.Lock()
+	p.step = name
+	p.mux.mu.Unlock()
+}
+
+// String returns the prefix. It must be called with mux.mu held.
+func (p *linePrefix) String() string {
+	label := namespaced(p.mux.config, p.node.ID)
+	if p.mux.prefixStep && p.step != "" {
+		label += "/" + p.step
+	}
+
+	color, ok := p.mux.colors[p.node]
+	if !ok {
+		return fmt.Sprintf("[%s] ", label)
+	}
+	return fmt.Sprintf("%s[%s]%s ", color, label, colorReset)
+}
+
+// lineWriter buffers the output until there's a whole line, and then writes the line
+// with a prefix. Writing a line is serialized by the mux, so a line is never split.
+// The buffer is guarded by the mux as well, since a service keeps writing after its
+// job has finished and been flushed.
+type lineWriter struct {
+	prefix *linePrefix
+	out    io.Writer
+	buf    []byte
+}
+
+// SetStep sets the step name that will be used in the prefix
+func (w *lineWriter) SetStep(name string) {
+	w.prefix.SetStep(name)
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.prefix.mux.mu.Lock()
+	defer w.prefix.mux.mu.Unlock()
+
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 && len(w.buf) < maxLineSize {
+			break
+		}
+
+		if i < 0 {
+			i = maxLineSize - 1
+		}
+
+		err := w.writeLine(w.buf[:i+1])
+		w.buf = append(w.buf[:0], w.buf[i+1:]...)
+		if err != nil {
+			return len(p), err
+		}
+	}
+	return len(p), nil
+}
+
+// Flush writes whatever is left in the buffer as a line
+func (w *lineWriter) Flush() error {
+	w.prefix.mux.mu.Lock()
+	defer w.prefix.mux.mu.Unlock()
+
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	err := w.writeLine(w.buf)
+	w.buf = w.buf[:0]
+	return err
+}
+
+// writeLine writes line with the prefix. It must be called with mux.mu held.
+func (w *lineWriter) writeLine(line []byte) error {
+	var b bytes.Buffer
+	b.WriteString(w.prefix.String())
+	b.Write(line)
+	if line[len(line)-1] != '\n' {
+		b.WriteByte('\n')
+	}
+	_, err := w.out.Write(b.Bytes())
+	return err
+}
+
+// spillBuffer keeps the written data in memory until it grows past limit.
+// After that, everything will be spilled to a temporary file.
+//
+// Once it's closed, the writes are discarded, e.g. the output from a service that
+// keeps running after its job finished.
+type spillBuffer struct {
+	mu     sync.Mutex
+	limit  int
+	mem    bytes.Buffer
+	file   *os.File
+	closed bool
+}
+
+func (b *spillBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return len(p), nil
+	}
+
+	if b.file == nil && b.mem.Len()+len(p) <= b.limit {
+		return b.mem.Write(p)
+	}
+
+	if b.file == nil {
+		f, err := ioutil.TempFile("", "gotopus-*.log")
+		if err != nil {
+			return 0, err
+		}
+
+		b.file = f
+		if _, err := b.mem.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+
+	return b.file.Write(p)
+}
+
+// WriteTo writes everything that has been written to b to w
+func (b *spillBuffer) WriteTo(w io.Writer) (int64, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.file == nil {
+		return b.mem.WriteTo(w)
+	}
+
+	if _, err := b.file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	return io.Copy(w, b.file)
+}
+
+// Close removes the temporary file if the data has been spilled
+func (b *spillBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	if b.file == nil {
+		return nil
+	}
+
+	b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// tailBuffer only keeps the last size bytes that were written to it
+type tailBuffer struct {
+	size int
+	buf  []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.size {
+		b.buf = append(b.buf[:0], b.buf[len(b.buf)-b.size:]...)
+	}
+	return len(p), nil
+}
+
+// lockedWriter serializes the writes to w, so that w can be shared by goroutines
+type lockedWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (w *lockedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.w.Write(p)
+}
+
+// sameWriter reports whether a and b are the same writer. Writers that can't be
+// compared are never the same.
+func sameWriter(a, b io.Writer) (same bool) {
+	defer func() {
+		if recover() != nil {
+			same = false
+		}
+	}()
+	return a == b
+}
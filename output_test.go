@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestOutputMuxUnknownMode(t *testing.T) {
+	_, err := newOutputMux(RunOptions{Output: "unknown"}, nil)
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+}
+
+func TestOutputMuxStream(t *testing.T) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	mux, err := newOutputMux(RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := mux.job(NewNode(Job{}, "job1"))
+	if out.Stdout != &stdoutBuf || out.Stderr != &stderrBuf {
+		t.Fatal("expected the stream output to write to the given writers directly")
+	}
+}
+
+func TestOutputMuxPrefixed(t *testing.T) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	opts := RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf, Output: OutputPrefixed}
+	mux, err := newOutputMux(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := mux.job(NewNode(Job{}, "job1"))
+	out.Stdout.Write([]byte("line1\nli"))
+	out.Stdout.Write([]byte("ne2\nline3"))
+	out.Stderr.Write([]byte("error\n"))
+	if err := out.Finish(ResultNode{}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[job1] line1\n[job1] line2\n[job1] line3\n"
+	if actual := stdoutBuf.String(); actual != expected {
+		t.Fatalf("expected the output to be \"%s\", but got \"%s\"", expected, actual)
+	}
+
+	expected = "[job1] error\n"
+	if actual := stderrBuf.String(); actual != expected {
+		t.Fatalf("expected the error output to be \"%s\", but got \"%s\"", expected, actual)
+	}
+}
+
+func TestOutputMuxPrefixedWithStepAndColor(t *testing.T) {
+	var stdoutBuf bytes.Buffer
+	job1, job2 := NewNode(Job{}, "job1"), NewNode(Job{}, "job2")
+	opts := RunOptions{Stdout: &stdoutBuf, Output: OutputPrefixed, PrefixStep: true, Color: true}
+	mux, err := newOutputMux(opts, []*Node{job1, job2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := mux.job(job2)
+	setStep(out.Stdout, "build")
+	out.Stdout.Write([]byte("done\n"))
+	out.Stderr.Write([]byte("warning\n"))
+
+	expected := outputColors[1] + "[job2/build]" + colorReset + " done\n" +
+		outputColors[1] + "[job2/build]" + colorReset + " warning\n"
+	if actual := stdoutBuf.String(); actual != expected {
+		t.Fatalf("expected the output to be %q, but got %q", expected, actual)
+	}
+}
+
+func TestOutputMuxPrefixedLongLine(t *testing.T) {
+	var stdoutBuf bytes.Buffer
+	mux, err := newOutputMux(RunOptions{Stdout: &stdoutBuf, Output: OutputPrefixed}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := mux.job(NewNode(Job{}, "job1"))
+	out.Stdout.Write(bytes.Repeat([]byte("a"), maxLineSize+1))
+	out.Finish(ResultNode{})
+
+	lines := strings.Split(strings.TrimSpace(stdoutBuf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected the long line to be broken into 2 lines, but got %d lines", len(lines))
+	}
+
+	if lines[1] != "[job1] a" {
+		t.Fatalf("expected the second line to be \"[job1] a\", but got \"%s\"", lines[1])
+	}
+}
+
+func TestOutputMuxPrefixedConcurrentJobs(t *testing.T) {
+	var stdoutBuf bytes.Buffer
+	mux, err := newOutputMux(RunOptions{Stdout: &stdoutBuf, Output: OutputPrefixed}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	ids := []string{"job1", "job2", "job3"}
+	for _, id := range ids {
+		wg.Add(1)
+		go func(id string) {
+			defer wg.Done()
+			out := mux.job(NewNode(Job{}, id))
+			for i := 0; i < 100; i++ {
+				// Write a line in small pieces to give other jobs a chance to interleave
+				for _, piece := range []string{id, "-", "line", "\n"} {
+					out.Stdout.Write([]byte(piece))
+				}
+			}
+			out.Finish(ResultNode{})
+		}(id)
+	}
+	wg.Wait()
+
+	lines := strings.Split(strings.TrimSpace(stdoutBuf.String()), "\n")
+	if len(lines) != len(ids)*100 {
+		t.Fatalf("expected to get %d lines, but got %d lines", len(ids)*100, len(lines))
+	}
+
+	for _, line := range lines {
+		var valid bool
+		for _, id := range ids {
+			if line == "["+id+"] "+id+"-line" {
+				valid = true
+			}
+		}
+
+		if !valid {
+			t.Fatalf("expected every line to come from a single job, but got \"%s\"", line)
+		}
+	}
+}
+
+func TestRunWithPrefixedOutput(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{{Run: "echo test1 && echo test2"}}},
+		},
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf, Output: OutputPrefixed})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[job1] test1\n[job1] test2\n"
+	if actual := stdoutBuf.String(); actual != expected {
+		t.Fatalf("expected the output to be \"%s\", but got \"%s\"", expected, actual)
+	}
+}
+
+func TestRunWithPrefixedOutputPartialLine(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{
+				{Name: "first", Run: "printf partial"},
+				{Name: "second", Run: "echo whole"},
+			}},
+		},
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf, Output: OutputPrefixed, PrefixStep: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "[job1/first] partial\n[job1/second] whole\n"
+	if actual := stdoutBuf.String(); actual != expected {
+		t.Fatalf("expected the output to be \"%s\", but got \"%s\"", expected, actual)
+	}
+}
+
+func TestOutputMuxGrouped(t *testing.T) {
+	var stdoutBuf, stderrBuf bytes.Buffer
+	opts := RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf, Output: OutputGrouped}
+	mux, err := newOutputMux(opts, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	job1 := NewNode(Job{Name: "Job 1"}, "job1")
+	job2 := NewNode(Job{}, "job2")
+	out1, out2 := mux.job(job1), mux.job(job2)
+	out1.Stdout.Write([]byte("job1 line1\n"))
+	out2.Stdout.Write([]byte("job2 line1\n"))
+	out1.Stderr.Write([]byte("job1 line2\n"))
+
+	if stdoutBuf.Len() != 0 {
+		t.Fatalf("expected nothing to be written before the jobs finish, but got \"%s\"", stdoutBuf.String())
+	}
+
+	err = out2.Finish(ResultNode{Node: job2, Err: errors.New("exit status 1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = out1.Finish(ResultNode{Node: job1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "==> job2\njob2 line1\n<== job2 failed: exit status 1 in 0s\n" +
+		"==> job1 (Job 1)\njob1 line1\njob1 line2\n<== job1 succeeded in 0s\n"
+	if actual := stdoutBuf.String(); actual != expected {
+		t.Fatalf("expected the output to be \"%s\", but got \"%s\"", expected, actual)
+	}
+
+	if stderrBuf.Len() != 0 {
+		t.Fatalf("expected the error output to be empty, but got \"%s\"", stderrBuf.String())
+	}
+}
+
+func TestSpillBuffer(t *testing.T) {
+	buf := &spillBuffer{limit: 8}
+	defer buf.Close()
+
+	buf.Write([]byte("1234"))
+	if buf.file != nil {
+		t.Fatal("expected the data to be kept in memory")
+	}
+
+	buf.Write([]byte("56789"))
+	if buf.file == nil {
+		t.Fatal("expected the data to be spilled to a file")
+	}
+	name := buf.file.Name()
+
+	var out bytes.Buffer
+	if _, err := buf.WriteTo(&out); err != nil {
+		t.Fatal(err)
+	}
+
+	if out.String() != "123456789" {
+		t.Fatalf("expected to read back \"123456789\", but got \"%s\"", out.String())
+	}
+
+	if err := buf.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Fatalf("expected %s to be removed", name)
+	}
+}
+
+func TestRunWithGroupedOutput(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{{Run: "echo test1 && echo test2 >&2"}}},
+		},
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf, Output: OutputGrouped})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdoutBuf.String()), "\n")
+	if len(lines) != 4 {
+		t.Fatalf("expected to get 4 lines, but got \"%s\"", stdoutBuf.String())
+	}
+
+	if lines[0] != "==> job1" || lines[1] != "test1" || lines[2] != "test2" {
+		t.Fatalf("expected the job output to be grouped, but got \"%s\"", stdoutBuf.String())
+	}
+
+	if !strings.HasPrefix(lines[3], "<== job1 succeeded in ") {
+		t.Fatalf("expected the footer to say the job succeeded, but got \"%s\"", lines[3])
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+)
+
+// newKeyValueFile creates an empty file that a step can write "key=value" lines to,
+// like GOTOPUS_OUTPUT and GOTOPUS_ENV. The caller is responsible for removing it.
+func newKeyValueFile() (string, error) {
+	f, err := ioutil.TempFile("", "gotopus-")
+	if err != nil {
+		return "", err
+	}
+	return f.Name(), f.Close()
+}
+
+// readKeyValues reads "key=value" lines from the file at path. Empty lines are ignored,
+// and a key that's written multiple times keeps the last value. A value can span
+// multiple lines with a delimiter like a heredoc:
+//
+//	key<<EOF
+//	line1
+//	line2
+//	EOF
+func readKeyValues(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, maxLineSize)
+	var lineNumber int
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		if i := strings.Index(line, "<<"); i > 0 && !strings.Contains(line[:i], "=") {
+			key, delimiter := line[:i], line[i+2:]
+			var lines []string
+			var terminated bool
+			for scanner.Scan() {
+				lineNumber++
+				if scanner.Text() == delimiter {
+					terminated = true
+					break
+				}
+				lines = append(lines, scanner.Text())
+			}
+
+			if !terminated {
+				return nil, fmt.Errorf("%s: missing %s delimiter of %s", path, delimiter, key)
+			}
+			values[key] = strings.Join(lines, "\n")
+			continue
+		}
+
+		i := strings.Index(line, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("%s:%d: expected key=value or key<<delimiter, but got %q", path, lineNumber, line)
+		}
+		values[line[:i]] = line[i+1:]
+	}
+	return values, scanner.Err()
+}
+
+// checkOutputNames makes sure that the outputs get distinct environment variables
+// in the jobs that need them, e.g. a-b and a_b would both get GOTOPUS_NEEDS_<JOB>_A_B
+func checkOutputNames(outputs map[string]string) error {
+	keys := make([]string, 0, len(outputs))
+	for k := range outputs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	names := make(map[string]string, len(keys))
+	for _, k := range keys {
+		name := envName(k)
+		if other, ok := names[name]; ok {
+			return fmt.Errorf("%s and %s outputs would both be passed as GOTOPUS_NEEDS_<JOB>_%s", other, k, name)
+		}
+		names[name] = k
+	}
+	return nil
+}
+
+// newNeedsEnv creates the builtin environments with the outputs of the dependencies
+// of n, e.g. GOTOPUS_NEEDS_BUILD_VERSION for the version output of the build job
+func newNeedsEnv(n *Node, outputs map[*Node]map[string]string) Env {
+	env := make(Env)
+	for dep := range n.Dependencies {
+		for k, v := range outputs[dep] {
+			env.SetBuiltin("NEEDS_"+envName(dep.ID)+"_"+envName(k), v)
+		}
+	}
+	return env
+}
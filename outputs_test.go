@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	if _, err := f.WriteString(content); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestReadKeyValues(t *testing.T) {
+	path := writeTempFile(t, "version=1.0.0\nversion=1.2.3\n\nurl=https://example.com?a=b\nnotes<<EOF\nline1\nline2\nEOF\n")
+	defer os.Remove(path)
+
+	values, err := readKeyValues(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"version": "1.2.3",
+		"url":     "https://example.com?a=b",
+		"notes":   "line1\nline2",
+	}
+	for k, v := range expected {
+		if values[k] != v {
+			t.Fatalf("expected %s to be \"%s\", but got \"%s\"", k, v, values[k])
+		}
+	}
+}
+
+func TestReadKeyValuesInvalidLine(t *testing.T) {
+	path := writeTempFile(t, "version=1.2.3\nbroken\n")
+	defer os.Remove(path)
+
+	_, err := readKeyValues(path)
+	if err == nil {
+		t.Fatal("expected to get an error due to an invalid line")
+	}
+}
+
+func TestReadKeyValuesMissingDelimiter(t *testing.T) {
+	path := writeTempFile(t, "notes<<EOF\nline1\n")
+	defer os.Remove(path)
+
+	_, err := readKeyValues(path)
+	if err == nil {
+		t.Fatal("expected to get an error due to a missing delimiter")
+	}
+}
+
+func TestNewNeedsEnv(t *testing.T) {
+	build := NewNode(Job{}, "build-app")
+	deploy := NewNode(Job{}, "deploy")
+	deploy.Dependencies[build] = struct{}{}
+
+	env := newNeedsEnv(deploy, map[*Node]map[string]string{build: {"version": "1.2.3"}})
+	if v := env["GOTOPUS_NEEDS_BUILD_APP_VERSION"]; v != "1.2.3" {
+		t.Fatalf("expected GOTOPUS_NEEDS_BUILD_APP_VERSION to be \"1.2.3\", but got \"%v\"", v)
+	}
+}
+
+func TestNewNeedsEnvWithNamespacedMatrixDependency(t *testing.T) {
+	test := NewNode(Job{}, "lint/test(go=1.20)")
+	deploy := NewNode(Job{}, "deploy")
+	deploy.Dependencies[test] = struct{}{}
+
+	env := newNeedsEnv(deploy, map[*Node]map[string]string{test: {"cover-profile": "cover.out"}})
+	if v := env["GOTOPUS_NEEDS_LINT_TEST_GO_1_20_COVER_PROFILE"]; v != "cover.out" {
+		t.Fatalf("expected GOTOPUS_NEEDS_LINT_TEST_GO_1_20_COVER_PROFILE to be \"cover.out\", but got \"%v\"", v)
+	}
+}
+
+func TestCheckOutputNames(t *testing.T) {
+	expected := "a-b and a_b outputs would both be passed as GOTOPUS_NEEDS_<JOB>_A_B"
+	err := checkOutputNames(map[string]string{"a_b": "1", "a-b": "2", "c": "3"})
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%v\"", expected, err)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WritePlan writes what running the graph from root would do to w without executing
+// anything. The jobs are grouped into waves in the order that the scheduler would
+// release them. Every step is listed with its command and the environment variables
+// that gotopus would set, except for the system environment variables and
+// GOTOPUS_WORKER_ID, which is only known at runtime.
+func WritePlan(w io.Writer, root *Node) error {
+	bw := bufio.NewWriter(w)
+	for i, wave := range root.Waves() {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+
+		fmt.Fprintf(bw, "Wave %d:\n", i+1)
+		for _, node := range wave {
+			writeJobPlan(bw, node)
+		}
+	}
+	return bw.Flush()
+}
+
+func writeJobPlan(w io.Writer, n *Node) {
+	if n.Job.Name != "" {
+		fmt.Fprintf(w, "  %s (%s)\n", n.ID, n.Job.Name)
+	} else {
+		fmt.Fprintf(w, "  %s\n", n.ID)
+	}
+
+	if len(n.Dependencies) > 0 {
+		var deps []string
+		for _, dep := range sortedNodes(n.Dependencies) {
+			deps = append(deps, dep.ID)
+		}
+		fmt.Fprintf(w, "    needs: %s\n", strings.Join(deps, ", "))
+	}
+
+	if n.Job.If != "" {
+		fmt.Fprintf(w, "    if: %s\n", n.Job.If)
+	}
+
+	if n.Job.Service {
+		fmt.Fprintf(w, "    service: ready when %s passes\n", n.Job.Readiness)
+	}
+
+	jobEnv := newJobEnv(n, 1)
+	for i, step := range n.Job.Steps {
+		fmt.Fprintf(w, "    step %s\n", stepLabel(i, step))
+		if step.If != "" {
+			fmt.Fprintf(w, "      if: %s\n", step.If)
+		}
+		fmt.Fprintln(w, "      run: |")
+		for _, line := range strings.Split(strings.TrimRight(step.Run, "\n"), "\n") {
+			fmt.Fprintf(w, "        %s\n", line)
+		}
+
+		env := make(Env)
+		for k, v := range jobEnv {
+			env.Set(k, v)
+		}
+
+		for k, v := range newStepEnv(step, 0, 1) {
+			env.Set(k, v)
+		}
+		delete(env, EnvBuiltinPrefix+"WORKER_ID")
+
+		fmt.Fprintln(w, "      env:")
+		for _, kv := range env.Encode() {
+			fmt.Fprintf(w, "        %s\n", kv)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWritePlan(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {
+				Name: "Build",
+				Steps: []Step{
+					{Name: "compile", Run: "go build\ngo vet", Env: map[string]string{"CGO_ENABLED": "0"}},
+				},
+			},
+			"test": {
+				Needs: []string{"build"},
+				Steps: []Step{{Run: "go test"}},
+			},
+		},
+	}
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = WritePlan(&buf, graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := `Wave 1:
+  build (Build)
+    step "compile"
+      run: |
+        go build
+        go vet
+      env:
+        CGO_ENABLED=0
+        GOTOPUS_ATTEMPT=1
+        GOTOPUS_JOB_ATTEMPT=1
+        GOTOPUS_JOB_ID=build
+        GOTOPUS_JOB_NAME=Build
+        GOTOPUS_STEP_NAME=compile
+
+Wave 2:
+  test
+    needs: build
+    step #1
+      run: |
+        go test
+      env:
+        GOTOPUS_ATTEMPT=1
+        GOTOPUS_JOB_ATTEMPT=1
+        GOTOPUS_JOB_ID=test
+        GOTOPUS_JOB_NAME=
+        GOTOPUS_STEP_NAME=
+`
+	if actual := buf.String(); actual != expected {
+		t.Fatalf("expected the plan to be\n%s\nbut got\n%s", expected, actual)
+	}
+}
+
+func TestRunWithDryRun(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{{Run: "echo $((1+1))"}}},
+		},
+	}
+
+	var stdoutBuf bytes.Buffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if bytes.Contains(stdoutBuf.Bytes(), []byte("\n2\n")) {
+		t.Fatalf("expected the step to not be executed, but got \"%s\"", stdoutBuf.String())
+	}
+
+	if !bytes.HasPrefix(stdoutBuf.Bytes(), []byte("Wave 1:\n  job1\n")) {
+		t.Fatalf("expected the plan to be written, but got \"%s\"", stdoutBuf.String())
+	}
+}
+
+func TestWritePlanWithService(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"db": {
+				Service:   true,
+				Steps:     []Step{{Run: "postgres"}},
+				Readiness: Readiness{TCP: "localhost:5432"},
+			},
+		},
+	}
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	err = WritePlan(&buf, graph)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "  db\n    service: ready when tcp localhost:5432 passes\n") {
+		t.Fatalf("expected the plan to describe the readiness of db, but got \"%s\"", buf.String())
+	}
+}
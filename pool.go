@@ -7,13 +7,15 @@ import (
 	"math"
 	"os"
 	"os/exec"
+	"sync"
+	"time"
 )
 
 var (
 	executeCmd = initExecuteCmd()
 )
 
-func initExecuteCmd() func(context.Context, string) *exec.Cmd {
+func initExecuteCmd() func(string) *exec.Cmd {
 	shellPath := os.Getenv("SHELL")
 	// If we can't find the current shell, we'll try to lookup the shell paths
 	supportedShells := []string{"bash", "sh", "zsh"}
@@ -30,8 +32,65 @@ func initExecuteCmd() func(context.Context, string) *exec.Cmd {
 		panic("failed to find a shell")
 	}
 
-	return func(ctx context.Context, cmd string) *exec.Cmd {
-		return exec.CommandContext(ctx, shellPath, "-c", cmd)
+	return func(cmd string) *exec.Cmd {
+		c := exec.Command(shellPath, "-c", cmd)
+		setProcessGroup(c)
+		return c
+	}
+}
+
+// runCmd starts cmd and waits for it to finish. When ctx is done before cmd finishes,
+// cmd and all of its children will receive SIGTERM. If they're still running after
+// gracePeriod, they'll be killed with SIGKILL.
+func runCmd(ctx context.Context, cmd *exec.Cmd, gracePeriod time.Duration) error {
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	runningCmds.Lock()
+	runningCmds.cmds[cmd] = struct{}{}
+	runningCmds.Unlock()
+	defer func() {
+		runningCmds.Lock()
+		delete(runningCmds.cmds, cmd)
+		runningCmds.Unlock()
+	}()
+
+	done := make(chan error, 1)
+	go func() { done <- cmd.Wait() }()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+	}
+
+	terminateProcessTree(cmd)
+	timer := time.NewTimer(gracePeriod)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	killProcessTree(cmd)
+	return <-done
+}
+
+// runningCmds are the commands that runCmd is waiting for, so that they can all be
+// killed at once
+var runningCmds = struct {
+	sync.Mutex
+	cmds map[*exec.Cmd]struct{}
+}{cmds: make(map[*exec.Cmd]struct{})}
+
+// killRunningCmds kills every command that runCmd is waiting for along with its children
+func killRunningCmds() {
+	runningCmds.Lock()
+	defer runningCmds.Unlock()
+	for cmd := range runningCmds.cmds {
+		killProcessTree(cmd)
 	}
 }
 
@@ -45,6 +104,59 @@ type Worker struct {
 	// If nil, Stdout will be instead.
 	Stderr io.Writer
 	Env    []string
+	// GracePeriod is how long a step has to exit after SIGTERM before it gets SIGKILL.
+	// If 0, the step gets SIGKILL right after SIGTERM
+	GracePeriod time.Duration
+	// Events receives the lifecycle events of the job and its steps. If nil, no events will be emitted.
+	Events *EventLog
+	// Needs describes the finished dependencies of the job for the if expressions of its steps
+	Needs map[string]NeedContext
+	// CacheDir is where the paths from the cache of the job are stored. If empty,
+	// nothing will be cached
+	CacheDir string
+	// StderrTailSize is how many bytes from the end of the stderr of every step
+	// are kept in the report. If 0, stderr won't be captured.
+	StderrTailSize int
+	// Report is filled by Execute with how the last executed job went
+	Report JobReport
+
+	// service is set by Execute when the job is a service that's ready, and
+	// keeps running in the background
+	service *service
+}
+
+// StepReport describes how a step went after it had been executed
+type StepReport struct {
+	// Name is the name of the step
+	Name string
+	// Attempts is the number of times the step was run
+	Attempts int
+	// Duration is how long the step took, including all of its attempts
+	Duration time.Duration
+	// ExitCode is the exit code from the last attempt. If the command couldn't
+	// start or was killed by a signal, it'll be -1
+	ExitCode int
+	// StderrTail is the end of stderr from the last attempt when the worker captures stderr
+	StderrTail string
+	// Skipped is true when the step didn't run because of its if expression
+	Skipped bool
+	// Err is the error from the last attempt
+	Err error
+}
+
+// JobReport describes how a job went after it had been executed
+type JobReport struct {
+	// Duration is how long the job took, including all of its attempts
+	Duration time.Duration
+	// Attempts is the number of times the job was run
+	Attempts int
+	// Steps contains a report for every step that was run in the last attempt
+	Steps []StepReport
+	// Outputs contains the key-value pairs that the steps wrote to GOTOPUS_OUTPUT
+	// in the last attempt
+	Outputs map[string]string
+	// CacheHit is true when the cache of the job was restored before it ran
+	CacheHit bool
 }
 
 // Execute executes given job from n. Worker will execute steps from the given job
@@ -52,12 +164,30 @@ type Worker struct {
 // Environment variables will be set appropriate before the shell command runs.
 // There are 2 kinds of environment variables: builtin and user-space.
 // Following are available builtin environment variables:
-// 	- GOTOPUS_JOB_ID
-//  - GOTOPUS_JOB_NAME
-//  - GOTOPUS_STEP_NAME
-//  - GOTOPUS_WORKER_ID
+//   - GOTOPUS_JOB_ID
+//   - GOTOPUS_JOB_NAME
+//   - GOTOPUS_JOB_ATTEMPT
+//   - GOTOPUS_STEP_NAME
+//   - GOTOPUS_ATTEMPT
+//   - GOTOPUS_WORKER_ID
+//   - GOTOPUS_OUTPUT
+//   - GOTOPUS_ENV
+//   - GOTOPUS_CACHE_HIT, only when the job has a cache
+//
+// GOTOPUS_OUTPUT and GOTOPUS_ENV are paths to files where the step can write "key=value"
+// lines. After the step succeeds, the outputs are collected into w.Report.Outputs, and
+// the environments are set for the next steps of the job.
+//
+// The user-space environment variables come from the env of the job and its steps.
 //
-// User-space environment variables are given from the config
+// When the job is a service, its last step is started in the background, and Execute
+// returns once the readiness probe passes. The service keeps running until the
+// worker's context is done, or the scheduler stops it.
+//
+// If the job or the step has a timeout, or the worker's context is done, the running
+// command will be terminated along with its children. If the job or the step has
+// a retry policy, it'll be re-run before giving up. How many attempts were needed
+// is stored in w.Report.
 func (w *Worker) Execute(n *Node) error {
 	if w.Stdout == nil {
 		return fmt.Errorf("Stdout is required to be not nil")
@@ -67,28 +197,313 @@ func (w *Worker) Execute(n *Node) error {
 		w.Stderr = w.Stdout
 	}
 
-	jobEnv := make(Env)
-	jobEnv.SetBuiltin("JOB_ID", n.ID)
-	jobEnv.SetBuiltin("JOB_NAME", n.Job.Name)
-	jobEnvEncoded := append(w.Env, jobEnv.Encode()...)
-	for _, step := range n.Job.Steps {
-		stepEnv := make(Env)
-		stepEnv.SetBuiltin("WORKER_ID", w.id)
-		stepEnv.SetBuiltin("STEP_NAME", step.Name)
+	w.Report = JobReport{}
+	w.service = nil
+	w.Events.Emit(Event{Type: EventJobStarted, Job: n.ID, WorkerID: &w.id})
+	start := time.Now()
+	cacheKey, err := w.restoreCache(n)
+	if err != nil {
+		w.Report.Duration = time.Since(start)
+		return err
+	}
 
-		for k, v := range step.Env {
-			stepEnv.Set(k, v)
+	attempts, err := retry(w.ctx, n.Job.Retry, func(attempt int) error {
+		w.Report.Steps = nil
+		w.Report.Outputs = make(map[string]string)
+		err := w.executeJob(n, attempt)
+		if err != nil && w.service != nil {
+			w.service.stop()
+			w.service = nil
 		}
-		cmd := executeCmd(w.ctx, step.Run)
-		cmd.Env = append(jobEnvEncoded, stepEnv.Encode()...)
-		cmd.Stdout = w.Stdout
-		cmd.Stderr = w.Stderr
-		if err := cmd.Run(); err != nil {
-			return err
+		return err
+	})
+
+	if err == nil && cacheKey != "" && !w.Report.CacheHit {
+		// Failing to save the cache only makes the next run slower, so the job still succeeds
+		if err := (cacheStore{dir: w.CacheDir}).save(cacheKey, n.Job.Cache.Paths); err != nil {
+			fmt.Fprintf(w.Stderr, "failed to save the cache with key %s: %v\n", cacheKey, err)
 		}
 	}
+	w.Report.Duration = time.Since(start)
+	w.Report.Attempts = attempts
+	if err != nil && attempts > 1 {
+		return fmt.Errorf("job %s failed after %d attempts: %w", n.ID, attempts, err)
+	}
+	return err
+}
+
+// restoreCache restores the cache of n when there's one, and returns its key.
+// If n doesn't have a cache, an empty key will be returned.
+func (w *Worker) restoreCache(n *Node) (string, error) {
+	if w.CacheDir == "" || n.Job.Cache.Key == "" {
+		return "", nil
+	}
+
+	env := append(append([]string(nil), w.Env...), newJobEnv(n, 1).Encode()...)
+	key, err := interpolate(n.Job.Cache.Key, ExprContext{Env: envMap(env), Matrix: n.Matrix, Needs: w.Needs})
+	if err != nil {
+		return "", fmt.Errorf("failed to evaluate the cache key of %s job: %w", n.ID, err)
+	}
 
-	return nil
+	// A broken cache shouldn't break the job, it'll be overwritten once the job succeeds
+	hit, err := cacheStore{dir: w.CacheDir}.restore(key)
+	if err != nil {
+		fmt.Fprintf(w.Stderr, "failed to restore the cache with key %s: %v\n", key, err)
+	} else if hit {
+		fmt.Fprintf(w.Stderr, "restored the cache with key %s\n", key)
+	}
+	w.Report.CacheHit = hit
+	return key, nil
+}
+
+// executeJob runs all steps from n once
+func (w *Worker) executeJob(n *Node, attempt int) error {
+	ctx := w.ctx
+	if n.Job.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.Job.Timeout)
+		defer cancel()
+	}
+
+	// w.Env is shared between workers, so it's copied before appending the job environments
+	jobEnv := newJobEnv(n, attempt)
+	if w.CacheDir != "" && n.Job.Cache.Key != "" {
+		jobEnv.SetBuiltin("CACHE_HIT", w.Report.CacheHit)
+	}
+	jobEnvEncoded := append(append([]string(nil), w.Env...), jobEnv.Encode()...)
+	// propagatedEnv collects what the steps wrote to GOTOPUS_ENV for the next steps
+	propagatedEnv := make(Env)
+	// jobErr is the error from the first failed step. The next steps only run when
+	// their if expressions ask for it, e.g. with always() or failure().
+	var jobErr error
+	for i, step := range n.Job.Steps {
+		setStep(w.Stdout, step.Name)
+		setStep(w.Stderr, step.Name)
+		report := StepReport{Name: step.Name}
+		conditionEnv := append(append(append([]string(nil), jobEnvEncoded...), propagatedEnv.Encode()...), newStepEnv(step, w.id, 1).Encode()...)
+		run, err := evalCondition(step.If, ExprContext{
+			Env:       envMap(conditionEnv),
+			Matrix:    n.Matrix,
+			Needs:     w.Needs,
+			Success:   jobErr == nil && ctx.Err() == nil,
+			Failure:   jobErr != nil,
+			Cancelled: ctx.Err() != nil,
+		})
+		if err != nil {
+			report.Err = fmt.Errorf("failed to evaluate if of step %s: %w", stepLabel(i, step), err)
+			w.Report.Steps = append(w.Report.Steps, report)
+			if jobErr == nil {
+				jobErr = report.Err
+			}
+			continue
+		}
+
+		if !run {
+			report.Skipped = true
+			w.Report.Steps = append(w.Report.Steps, report)
+			w.Events.Emit(Event{
+				Type:     EventStepFinished,
+				Job:      n.ID,
+				Step:     i + 1,
+				StepName: step.Name,
+				WorkerID: &w.id,
+				Status:   StatusSkipped,
+			})
+			continue
+		}
+
+		attempts, err := retry(ctx, step.Retry, func(attempt int) error {
+			outputPath, err := newKeyValueFile()
+			if err != nil {
+				return err
+			}
+			defer os.Remove(outputPath)
+
+			envPath, err := newKeyValueFile()
+			if err != nil {
+				return err
+			}
+			defer os.Remove(envPath)
+
+			stepEnv := newStepEnv(step, w.id, attempt)
+			stepEnv.SetBuiltin("OUTPUT", outputPath)
+			stepEnv.SetBuiltin("ENV", envPath)
+			cmdEnv := append(append(append([]string(nil), jobEnvEncoded...), propagatedEnv.Encode()...), stepEnv.Encode()...)
+			if n.Job.Service && i == len(n.Job.Steps)-1 {
+				err = w.startService(ctx, n, i, attempt, cmdEnv, &report)
+			} else {
+				err = w.executeStep(ctx, n, i, attempt, cmdEnv, &report)
+			}
+			if err != nil {
+				return err
+			}
+
+			outputs, err := readKeyValues(outputPath)
+			if err != nil {
+				return err
+			}
+
+			env, err := readKeyValues(envPath)
+			if err != nil {
+				return err
+			}
+
+			for k, v := range outputs {
+				w.Report.Outputs[k] = v
+			}
+			if err := checkOutputNames(w.Report.Outputs); err != nil {
+				return err
+			}
+
+			for k, v := range env {
+				propagatedEnv.Set(k, v)
+			}
+			return nil
+		})
+		report.Attempts = attempts
+		report.Err = err
+		w.Report.Steps = append(w.Report.Steps, report)
+
+		if err != nil && ctx.Err() == context.DeadlineExceeded {
+			return fmt.Errorf("job %s timed out after %s", n.ID, n.Job.Timeout)
+		}
+
+		if err != nil && jobErr == nil {
+			jobErr = stepError(i, step, attempts, err)
+		}
+	}
+
+	return jobErr
+}
+
+// executeStep runs the shell command from the i-th step of n with env, and records
+// how it went to report. If the step timed out, context.DeadlineExceeded will be returned.
+func (w *Worker) executeStep(ctx context.Context, n *Node, i int, attempt int, env []string, report *StepReport) error {
+	step := n.Job.Steps[i]
+	if step.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, step.Timeout)
+		defer cancel()
+	}
+
+	w.Events.Emit(Event{
+		Type:     EventStepStarted,
+		Job:      n.ID,
+		Step:     i + 1,
+		StepName: step.Name,
+		WorkerID: &w.id,
+		Attempt:  attempt,
+	})
+	start := time.Now()
+	cmd := executeCmd(step.Run)
+	cmd.Env = env
+	cmd.Stdout = w.Stdout
+	cmd.Stderr = w.Stderr
+	var stderrTail *tailBuffer
+	if w.StderrTailSize > 0 {
+		stderrTail = &tailBuffer{size: w.StderrTailSize}
+		stdout, stderr := w.Stdout, w.Stderr
+		// exec only serializes the writes when stdout and stderr are the same writer,
+		// which stops being the case once stderr is also written to the tail
+		if sameWriter(stdout, stderr) {
+			shared := &lockedWriter{w: stdout}
+			stdout, stderr = shared, shared
+		}
+		cmd.Stdout = stdout
+		cmd.Stderr = io.MultiWriter(stderr, stderrTail)
+	}
+
+	err := runCmd(ctx, cmd, w.GracePeriod)
+	if err != nil && ctx.Err() == context.DeadlineExceeded {
+		err = ctx.Err()
+	}
+	flushLine(w.Stdout)
+	flushLine(w.Stderr)
+
+	code := exitCode(cmd)
+	report.Duration += time.Since(start)
+	report.ExitCode = code
+	if stderrTail != nil {
+		report.StderrTail = string(stderrTail.buf)
+	}
+	w.Events.Emit(Event{
+		Type:       EventStepFinished,
+		Job:        n.ID,
+		Step:       i + 1,
+		StepName:   step.Name,
+		WorkerID:   &w.id,
+		Attempt:    attempt,
+		Status:     statusOf(err),
+		ExitCode:   &code,
+		DurationMS: durationMS(time.Since(start)),
+		Error:      errorMessage(err),
+	})
+	return err
+}
+
+// exitCode returns the exit code of cmd that has been run. If cmd couldn't start
+// or was killed by a signal, -1 will be returned.
+func exitCode(cmd *exec.Cmd) int {
+	if cmd.ProcessState == nil {
+		return -1
+	}
+	return cmd.ProcessState.ExitCode()
+}
+
+// newJobEnv creates the builtin and user-space environments of n for the given job attempt
+func newJobEnv(n *Node, attempt int) Env {
+	env := make(Env)
+	env.SetBuiltin("JOB_ID", n.ID)
+	env.SetBuiltin("JOB_NAME", n.Job.Name)
+	env.SetBuiltin("JOB_ATTEMPT", attempt)
+	for k, v := range n.Matrix {
+		env.SetBuiltin("MATRIX_"+envName(k), v)
+	}
+
+	for k, v := range n.Job.Env {
+		env.Set(k, v)
+	}
+	return env
+}
+
+// newStepEnv creates the builtin and user-space environments of step that runs
+// on worker workerID for the given step attempt
+func newStepEnv(step Step, workerID uint64, attempt int) Env {
+	env := make(Env)
+	env.SetBuiltin("WORKER_ID", workerID)
+	env.SetBuiltin("STEP_NAME", step.Name)
+	env.SetBuiltin("ATTEMPT", attempt)
+
+	for k, v := range step.Env {
+		env.Set(k, v)
+	}
+	return env
+}
+
+// stepLabel returns a human-friendly label of the i-th step
+func stepLabel(i int, step Step) string {
+	if step.Name != "" {
+		return fmt.Sprintf("%q", step.Name)
+	}
+	return fmt.Sprintf("#%d", i+1)
+}
+
+// stepError decorates err from the i-th step with the step label and how many
+// attempts were made
+func stepError(i int, step Step, attempts int, err error) error {
+	label := stepLabel(i, step)
+	if err == context.DeadlineExceeded && attempts > 1 {
+		return fmt.Errorf("step %s timed out after %s (%d attempts)", label, step.Timeout, attempts)
+	}
+
+	if err == context.DeadlineExceeded {
+		return fmt.Errorf("step %s timed out after %s", label, step.Timeout)
+	}
+
+	if attempts > 1 {
+		return fmt.Errorf("step %s failed after %d attempts: %w", label, attempts, err)
+	}
+	return err
 }
 
 // PoolJob represents a job unit that can be submitted to a Pool.
@@ -107,6 +522,9 @@ type PoolJob func(Worker)
 //
 // If maxWorkers is 0, the pool can grow infinitely until it runs out of memory
 // to spawn more workers.
+//
+// The returned function can be called from multiple goroutines, so that a pool can
+// be shared by concurrent runs.
 func PoolStart(ctx context.Context, maxWorkers uint64) func(PoolJob) {
 	env := os.Environ()
 	jobChan := make(chan PoolJob)
@@ -126,16 +544,20 @@ func PoolStart(ctx context.Context, maxWorkers uint64) func(PoolJob) {
 		maxWorkers = math.MaxUint64
 	}
 
+	// The pool can be shared by concurrent runs, so growing it is guarded by mu
+	var mu sync.Mutex
 	var numWorkers uint64
 	return func(job PoolJob) {
 		select {
 		case jobChan <- job:
 		default:
 			// If the pool still can grow, we'll spawn another worker
+			mu.Lock()
 			if numWorkers < maxWorkers {
 				go createWorker(numWorkers)
 				numWorkers++
 			}
+			mu.Unlock()
 			jobChan <- job
 		}
 	}
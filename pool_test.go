@@ -247,7 +247,375 @@ func TestWorkerExecuteWithoutStdout(t *testing.T) {
 	}
 }
 
+func TestWorkerExecuteStepTimeout(t *testing.T) {
+	steps := []Step{
+		{Name: "hang", Run: "sleep 5", Timeout: time.Millisecond * 100},
+		{Run: "echo done"},
+	}
+	job := Job{Steps: steps}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var stdoutBuf bytes.Buffer
+	result := make(chan error)
+	start := time.Now()
+	submit(func(w Worker) {
+		w.Stdout = &stdoutBuf
+		result <- w.Execute(node)
+	})
+
+	err := <-result
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Fatalf("expected the step to be killed, but it ran for %f seconds", elapsed.Seconds())
+	}
+
+	expected := "step \"hang\" timed out after 100ms"
+	if err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%s\"", expected, err)
+	}
+
+	out := stdoutBuf.String()
+	if strings.Contains(out, "done") {
+		t.Fatalf("expected the output to not contain done, but got \"%s\"", out)
+	}
+}
+
+func TestWorkerExecuteJobTimeout(t *testing.T) {
+	steps := []Step{
+		{Run: "echo start"},
+		{Run: "sleep 5", Timeout: time.Second * 10},
+	}
+	job := Job{Steps: steps, Timeout: time.Millisecond * 100}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var stdoutBuf bytes.Buffer
+	result := make(chan error)
+	submit(func(w Worker) {
+		w.Stdout = &stdoutBuf
+		result <- w.Execute(node)
+	})
+
+	err := <-result
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	expected := "job job1 timed out after 100ms"
+	if err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%s\"", expected, err)
+	}
+}
+
+func TestWorkerExecuteStepRetry(t *testing.T) {
+	steps := []Step{
+		{Name: "flaky", Run: `test "$GOTOPUS_ATTEMPT" -ge 3`, Retry: Retry{Attempts: 3}},
+		{Run: "echo done"},
+	}
+	job := Job{Steps: steps}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var stdoutBuf bytes.Buffer
+	result := make(chan JobReport)
+	submit(func(w Worker) {
+		w.Stdout = &stdoutBuf
+		if err := w.Execute(node); err != nil {
+			t.Error(err)
+		}
+		result <- w.Report
+	})
+
+	report := <-result
+	if report.Attempts != 1 {
+		t.Fatalf("expected the job to run once, but got %d attempts", report.Attempts)
+	}
+
+	if len(report.Steps) != 2 {
+		t.Fatalf("expected to get 2 step reports, but got %d", len(report.Steps))
+	}
+
+	if report.Steps[0].Attempts != 3 {
+		t.Fatalf("expected the flaky step to need 3 attempts, but got %d", report.Steps[0].Attempts)
+	}
+
+	if report.Steps[1].Attempts != 1 {
+		t.Fatalf("expected the last step to need 1 attempt, but got %d", report.Steps[1].Attempts)
+	}
+}
+
+func TestWorkerExecuteJobRetry(t *testing.T) {
+	steps := []Step{
+		{Run: "echo attempt${GOTOPUS_JOB_ATTEMPT}"},
+		{Run: `test "$GOTOPUS_JOB_ATTEMPT" -ge 2`},
+	}
+	job := Job{Steps: steps, Retry: Retry{Attempts: 2}}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var stdoutBuf bytes.Buffer
+	result := make(chan error)
+	submit(func(w Worker) {
+		w.Stdout = &stdoutBuf
+		result <- w.Execute(node)
+	})
+
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := stdoutBuf.String()
+	if out != "attempt1\nattempt2\n" {
+		t.Fatalf("expected the whole job to run twice, but got \"%s\"", out)
+	}
+}
+
+func TestWorkerExecuteRetryExhausted(t *testing.T) {
+	steps := []Step{{Name: "broken", Run: "exit 1", Retry: Retry{Attempts: 2}}}
+	job := Job{Steps: steps}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var stdoutBuf bytes.Buffer
+	result := make(chan error)
+	submit(func(w Worker) {
+		w.Stdout = &stdoutBuf
+		result <- w.Execute(node)
+	})
+
+	err := <-result
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	expected := "step \"broken\" failed after 2 attempts: exit status 1"
+	if err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%s\"", expected, err)
+	}
+}
+
+func TestWorkerExecuteTerminatesProcessTree(t *testing.T) {
+	// The background sleep keeps stdout open, so Execute can only return early
+	// when the grandchild gets terminated as well
+	steps := []Step{{Run: "sleep 30 & echo started; wait"}}
+	job := Job{Steps: steps}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	stdout := &syncBuffer{}
+	result := make(chan error)
+	submit(func(w Worker) {
+		w.Stdout = stdout
+		w.GracePeriod = time.Second * 5
+		result <- w.Execute(node)
+	})
+
+	for !strings.Contains(stdout.String(), "started") {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	start := time.Now()
+	cancel()
+	err := <-result
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Fatalf("expected the process tree to exit right after SIGTERM, but it took %f seconds", elapsed.Seconds())
+	}
+}
+
+func TestWorkerExecuteKillsAfterGracePeriod(t *testing.T) {
+	steps := []Step{{Run: "trap '' TERM; echo started; sleep 30"}}
+	job := Job{Steps: steps}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	stdout := &syncBuffer{}
+	result := make(chan error)
+	gracePeriod := time.Millisecond * 200
+	submit(func(w Worker) {
+		w.Stdout = stdout
+		w.GracePeriod = gracePeriod
+		result <- w.Execute(node)
+	})
+
+	for !strings.Contains(stdout.String(), "started") {
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	start := time.Now()
+	cancel()
+	err := <-result
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	elapsed := time.Since(start)
+	if elapsed < gracePeriod {
+		t.Fatalf("expected the step to have %s to exit, but it was killed after %s", gracePeriod, elapsed)
+	}
+
+	if elapsed > time.Second*2 {
+		t.Fatalf("expected the step to be killed after the grace period, but it took %f seconds", elapsed.Seconds())
+	}
+}
+
+func TestWorkerExecuteWithSharedStdoutAndStderr(t *testing.T) {
+	steps := []Step{
+		{Run: "for i in $(seq 100); do echo out; echo err >&2; done; exit 1"},
+	}
+	node := NewNode(Job{Steps: steps}, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var outputBuf bytes.Buffer
+	result := make(chan error)
+	submit(func(w Worker) {
+		w.Stdout = &outputBuf
+		w.Stderr = &outputBuf
+		w.StderrTailSize = 4
+		result <- w.Execute(node)
+	})
+
+	if err := <-result; err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	if actual := strings.Count(outputBuf.String(), "\n"); actual != 200 {
+		t.Fatalf("expected to get 200 lines, but got %d", actual)
+	}
+}
+
+func TestWorkerExecuteWithPropagatedEnv(t *testing.T) {
+	steps := []Step{
+		{Run: `echo "GREETING=hello" >> "$GOTOPUS_ENV" && echo "NAME=gotopus" >> "$GOTOPUS_ENV"`},
+		{Run: "echo $GREETING $NAME"},
+		{Run: "echo $GREETING $NAME", Env: map[string]string{"NAME": "world"}},
+	}
+	job := Job{Steps: steps}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var stdoutBuf bytes.Buffer
+	result := make(chan error)
+	submit(func(w Worker) {
+		w.Stdout = &stdoutBuf
+		result <- w.Execute(node)
+	})
+
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := stdoutBuf.String()
+	if out != "hello gotopus\nhello world\n" {
+		t.Fatalf("expected the next steps to get the environments, but got \"%s\"", out)
+	}
+}
+
+func TestWorkerExecuteWithStepConditions(t *testing.T) {
+	steps := []Step{
+		{Run: "echo step1", If: "env.GOTOPUS_JOB_ID == 'other'"},
+		{Run: "exit 1"},
+		{Run: "echo step3"},
+		{Run: "echo step4", If: "failure()"},
+		{Run: "echo step5", If: "always() && matrix.os == 'linux'"},
+	}
+	job := Job{Steps: steps}
+	node := NewNode(job, "job1")
+	node.Matrix = map[string]string{"os": "linux"}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var stdoutBuf bytes.Buffer
+	var report JobReport
+	result := make(chan error)
+	submit(func(w Worker) {
+		w.Stdout = &stdoutBuf
+		err := w.Execute(node)
+		report = w.Report
+		result <- err
+	})
+
+	err := <-result
+	if err == nil || err.Error() != "exit status 1" {
+		t.Fatalf("expected the job to fail with the error from the second step, but got \"%v\"", err)
+	}
+
+	out := stdoutBuf.String()
+	if out != "step4\nstep5\n" {
+		t.Fatalf("expected only step4 and step5 to run after the failure, but got \"%s\"", out)
+	}
+
+	if len(report.Steps) != 5 || !report.Steps[0].Skipped || !report.Steps[2].Skipped {
+		t.Fatalf("expected step1 and step3 to be reported as skipped, but got %+v", report.Steps)
+	}
+}
+
+func TestWorkerExecuteWithJobEnv(t *testing.T) {
+	job := Job{
+		Env: map[string]string{"GREETING": "hello", "NAME": "gotopus"},
+		Steps: []Step{
+			{Run: "echo $GREETING $NAME"},
+			{Run: "echo $GREETING $NAME", Env: map[string]string{"NAME": "world"}},
+		},
+	}
+	node := NewNode(job, "job1")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	submit := PoolStart(ctx, 0)
+	var stdoutBuf bytes.Buffer
+	result := make(chan error)
+	submit(func(w Worker) {
+		w.Stdout = &stdoutBuf
+		result <- w.Execute(node)
+	})
+
+	err := <-result
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out := stdoutBuf.String()
+	if out != "hello gotopus\nhello world\n" {
+		t.Fatalf("expected every step to get the job environments, but got \"%s\"", out)
+	}
+}
+
 func TestInitExecuteCmdNoShell(t *testing.T) {
+	shell, path := os.Getenv("SHELL"), os.Getenv("PATH")
+	defer func() {
+		os.Setenv("SHELL", shell)
+		os.Setenv("PATH", path)
+	}()
+
 	err := os.Unsetenv("SHELL")
 	if err != nil {
 		t.Fatal(err)
@@ -0,0 +1,21 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os/exec"
+)
+
+// setProcessGroup is a no-op on Windows since there are no process groups
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// terminateProcessTree kills cmd right away since Windows can't deliver SIGTERM
+func terminateProcessTree(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
+
+// killProcessTree forcefully kills cmd
+func killProcessTree(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
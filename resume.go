@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RunState is the progress of a run that's persisted to a file, so that a failed
+// run can be resumed without running the jobs that already succeeded
+type RunState struct {
+	// Config is the path of the config that's being run
+	Config string `json:"config"`
+	// Mode is how the configs of the run are run together, e.g. ModeMerged
+	Mode string `json:"mode,omitempty"`
+	// Completed maps the IDs of the jobs that succeeded to their outputs
+	Completed map[string]map[string]string `json:"completed"`
+
+	mu   sync.Mutex
+	path string
+}
+
+// newRunID creates an ID for a run that sorts by the time when it was created
+func newRunID() string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return time.Now().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// runStateDir returns where the states of run runID are kept
+func runStateDir(stateDir, runID string) string {
+	return filepath.Join(stateDir, "runs", runID)
+}
+
+// newRunStates creates and saves an empty state for every config of run runID,
+// where the configs are run in mode
+func newRunStates(stateDir, runID, mode string, configPaths []string) ([]*RunState, error) {
+	states := make([]*RunState, len(configPaths))
+	for i, configPath := range configPaths {
+		states[i] = &RunState{
+			Config:    configPath,
+			Mode:      mode,
+			Completed: make(map[string]map[string]string),
+			path:      filepath.Join(runStateDir(stateDir, runID), strconv.Itoa(i)+".json"),
+		}
+
+		if err := states[i].save(); err != nil {
+			return nil, err
+		}
+	}
+	return states, nil
+}
+
+// loadRunStates loads the states of every config of run runID in the order that
+// the configs were given
+func loadRunStates(stateDir, runID string) ([]*RunState, error) {
+	dir := runStateDir(stateDir, runID)
+	files, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to find %s run", runID)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	var states []*RunState
+	for _, file := range files {
+		i, err := strconv.Atoi(file.Name()[:len(file.Name())-len(filepath.Ext(file.Name()))])
+		if err != nil || filepath.Ext(file.Name()) != ".json" {
+			continue
+		}
+
+		data, err := ioutil.ReadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		state := &RunState{path: filepath.Join(dir, file.Name())}
+		if err := json.Unmarshal(data, state); err != nil {
+			return nil, fmt.Errorf("invalid state of %s run: %w", runID, err)
+		}
+
+		if state.Completed == nil {
+			state.Completed = make(map[string]map[string]string)
+		}
+
+		for len(states) <= i {
+			states = append(states, nil)
+		}
+		states[i] = state
+	}
+
+	for i, state := range states {
+		if state == nil {
+			return nil, fmt.Errorf("missing state of config #%d in %s run", i+1, runID)
+		}
+	}
+	return states, nil
+}
+
+// isCompleted returns the outputs of job id when it succeeded. A nil *RunState
+// doesn't have any completed jobs.
+func (s *RunState) isCompleted(id string) (map[string]string, bool) {
+	if s == nil {
+		return nil, false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	outputs, ok := s.Completed[id]
+	return outputs, ok
+}
+
+// complete records that job id succeeded with outputs, and saves the state.
+// A nil *RunState doesn't record anything.
+func (s *RunState) complete(id string, outputs map[string]string) error {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if outputs == nil {
+		outputs = make(map[string]string)
+	}
+	s.Completed[id] = outputs
+	return s.save()
+}
+
+// forget removes jobs ids from the completed jobs, so that they'll run again
+func (s *RunState) forget(ids []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, id := range ids {
+		delete(s.Completed, id)
+	}
+	return s.save()
+}
+
+// save writes the state to its file. A state without a file is only kept in memory.
+// s.mu must be held by the caller.
+func (s *RunState) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path, func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestRunStates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	states, err := newRunStates(dir, "run1", ModeConcurrent, []string{"a.yaml", "b.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = states[1].complete("job1", map[string]string{"version": "1.2.3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadRunStates(dir, "run1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(loaded) != 2 || loaded[0].Config != "a.yaml" || loaded[1].Config != "b.yaml" {
+		t.Fatalf("expected to load the states of a.yaml and b.yaml, but got %d states", len(loaded))
+	}
+
+	if loaded[0].Mode != ModeConcurrent {
+		t.Fatalf("expected the mode to be %s, but got %s", ModeConcurrent, loaded[0].Mode)
+	}
+
+	if _, ok := loaded[0].isCompleted("job1"); ok {
+		t.Fatal("expected job1 to not be completed in a.yaml")
+	}
+
+	outputs, ok := loaded[1].isCompleted("job1")
+	if !ok || outputs["version"] != "1.2.3" {
+		t.Fatalf("expected job1 to be completed in b.yaml with its outputs, but got %v", outputs)
+	}
+
+	if _, err := loadRunStates(dir, "run2"); err == nil {
+		t.Fatal("expected to get an error due to an unknown run")
+	}
+}
+
+func TestRunWithState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build":  {Steps: []Step{{Run: "echo build"}}},
+			"deploy": {Needs: []string{"build"}, Steps: []Step{{Run: "echo deploy $GOTOPUS_NEEDS_BUILD_VERSION"}}},
+			"lint":   {Steps: []Step{{Run: "echo lint"}}},
+		},
+	}
+
+	states, err := newRunStates(dir, "run1", ModeSequential, []string{"config.yaml"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	states[0].complete("build", map[string]string{"VERSION": "1.2.3"})
+
+	var stdoutBuf syncBuffer
+	err = RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, MaxWorkers: 1, State: states[0]})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := stdoutBuf.String(); actual != "deploy 1.2.3\nlint\n" {
+		t.Fatalf("expected build to not run again, but got \"%s\"", actual)
+	}
+
+	for _, id := range []string{"build", "deploy", "lint"} {
+		if _, ok := states[0].isCompleted(id); !ok {
+			t.Fatalf("expected %s to be recorded as completed", id)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// retry calls fn until it succeeds, the attempts from policy run out, or ctx is done.
+// fn will receive the current attempt number, which starts from 1. retry returns
+// the number of attempts that were made and the error from the last attempt.
+func retry(ctx context.Context, policy Retry, fn func(attempt int) error) (int, error) {
+	backoff := policy.Backoff
+	for attempt := 1; ; attempt++ {
+		err := fn(attempt)
+		if err == nil || attempt >= policy.Attempts || ctx.Err() != nil {
+			return attempt, err
+		}
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return attempt, err
+		}
+
+		if policy.Multiplier > 0 {
+			backoff = time.Duration(float64(backoff) * policy.Multiplier)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRetryUntilSuccess(t *testing.T) {
+	policy := Retry{Attempts: 5}
+	attempts, err := retry(context.Background(), policy, func(attempt int) error {
+		if attempt < 3 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if attempts != 3 {
+		t.Fatalf("expected to make 3 attempts, but got %d", attempts)
+	}
+}
+
+func TestRetryWithoutPolicy(t *testing.T) {
+	var policy Retry
+	attempts, err := retry(context.Background(), policy, func(attempt int) error {
+		return errors.New("failed")
+	})
+
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	if attempts != 1 {
+		t.Fatalf("expected to make 1 attempt, but got %d", attempts)
+	}
+}
+
+func TestRetryBackoffMultiplier(t *testing.T) {
+	policy := Retry{Attempts: 3, Backoff: time.Millisecond * 100, Multiplier: 2}
+	var calls []time.Time
+	attempts, err := retry(context.Background(), policy, func(attempt int) error {
+		calls = append(calls, time.Now())
+		return errors.New("failed")
+	})
+
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	if attempts != 3 {
+		t.Fatalf("expected to make 3 attempts, but got %d", attempts)
+	}
+
+	expectedBackoffs := []time.Duration{time.Millisecond * 100, time.Millisecond * 200}
+	for i, expected := range expectedBackoffs {
+		actual := calls[i+1].Sub(calls[i])
+		if actual < expected {
+			t.Fatalf("expected to wait at least %s before attempt %d, but waited %s", expected, i+2, actual)
+		}
+	}
+}
+
+func TestRetryStopsWhenContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	policy := Retry{Attempts: 3, Backoff: time.Hour}
+	attempts, err := retry(ctx, policy, func(attempt int) error {
+		cancel()
+		return errors.New("failed")
+	})
+
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	if attempts != 1 {
+		t.Fatalf("expected to make 1 attempt, but got %d", attempts)
+	}
+}
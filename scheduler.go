@@ -2,16 +2,157 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 // ResultNode represents a node that has been executed. ResultNode is used
 // to pass back a result from a separate goroutine to main goroutine.
 type ResultNode struct {
 	*Node
+	Err    error
+	Report JobReport
+	output jobOutput
+	// service is the running service when the job is a service that's ready
+	service *service
+	// cancelled is true when only the job was cancelled, and not the whole run
+	cancelled bool
+}
+
+// JobError represents a job that failed to execute
+type JobError struct {
+	// ID is the ID of the failed job
+	ID string
+	// Err is the reason why the job failed
 	Err error
 }
 
+// RunError reports every job that failed and every job that was skipped
+// because one of its transitive dependencies failed.
+type RunError struct {
+	// Failed is a list of failed jobs sorted by their IDs
+	Failed []JobError
+	// Skipped is a list of skipped job IDs in sorted order
+	Skipped []string
+}
+
+func (e *RunError) Error() string {
+	lines := []string{fmt.Sprintf("%d job(s) failed, %d job(s) skipped", len(e.Failed), len(e.Skipped))}
+	for _, failed := range e.Failed {
+		lines = append(lines, fmt.Sprintf("  %s failed: %v", failed.ID, failed.Err))
+	}
+	for _, id := range e.Skipped {
+		lines = append(lines, fmt.Sprintf("  %s skipped: a dependency failed", id))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// RunOptions configures how Run schedules and executes jobs
+type RunOptions struct {
+	// Context cancels the run when it's done. The running jobs will be terminated
+	// gracefully. If nil, context.Background() will be used.
+	Context context.Context
+	// Stdout is used to redirect the output from the shell command stdout
+	Stdout io.Writer
+	// Stderr is used to redirect the output from the shell command stderr.
+	// If nil, Stdout will be used instead.
+	Stderr io.Writer
+	// MaxWorkers limits the number of workers that can run concurrently.
+	// If 0, the pool can grow infinitely.
+	MaxWorkers uint64
+	// Pool runs the jobs. Runs that share a pool share its worker limit. If nil,
+	// a pool limited by MaxWorkers is started for the run.
+	Pool func(PoolJob)
+	// KeepGoing keeps running the independent branches of the graph after a job fails.
+	// Only the transitive dependents of the failed job will be skipped.
+	KeepGoing bool
+	// GracePeriod is how long a terminated job has to exit before it gets killed.
+	// If 0, the job gets SIGKILL right after SIGTERM
+	GracePeriod time.Duration
+	// Output is how the output from concurrent jobs is written to Stdout and Stderr.
+	// It's either OutputStream, OutputPrefixed, or OutputGrouped. If empty, OutputStream will be used.
+	Output string
+	// PrefixStep adds the step name to the prefix when Output is OutputPrefixed
+	PrefixStep bool
+	// Color gives every job a different prefix color when Output is OutputPrefixed
+	Color bool
+	// DryRun writes the execution plan to Stdout instead of running the jobs
+	DryRun bool
+	// Jobs limits the run to the jobs with these IDs and everything that they
+	// transitively depend on. If empty, every job will run.
+	Jobs []string
+	// Events receives the lifecycle events of the run. If nil, no events will be emitted.
+	Events *EventLog
+	// JUnit collects the results of the run. If nil, the results won't be collected.
+	JUnit *JUnitReport
+	// CacheDir is where the paths from the caches of the jobs are stored. If empty,
+	// nothing will be cached.
+	CacheDir string
+	// State records the jobs that succeeded, so that the run can be resumed. The jobs
+	// that are already in State are treated as succeeded without running them again.
+	// If nil, nothing will be recorded.
+	State *RunState
+	// StateDir is where the hashes of the jobs with inputs are kept to skip them when
+	// they're up to date. If empty, every job will run.
+	StateDir string
+	// ConfigName tells the jobs of the config apart from the jobs of the other configs
+	// that run at the same time. It prefixes the job IDs in the prefixed and grouped
+	// output, and in the JUnit report, and it's set on the events. If empty, only
+	// the job IDs are used.
+	ConfigName string
+
+	// startJob is called when a worker starts job id with ctx, and the job runs with
+	// the returned context instead. When the returned context is cancelled while ctx
+	// isn't, the job is skipped instead of failing the run. If nil, the jobs run with ctx.
+	startJob func(ctx context.Context, id string) context.Context
+}
+
+// dependenciesSucceeded returns true when every dependency of n succeeded
+func dependenciesSucceeded(n *Node, statuses map[*Node]string) bool {
+	for dep := range n.Dependencies {
+		if statuses[dep] != StatusSuccess {
+			return false
+		}
+	}
+	return true
+}
+
+// newNeedsContext describes the dependencies of n for expressions. Every dependency
+// can be referred to by its ID, or by its job ID when it's a matrix combination.
+func newNeedsContext(n *Node, statuses map[*Node]string, outputs map[*Node]map[string]string) map[string]NeedContext {
+	needs := make(map[string]NeedContext)
+	for _, dep := range sortedNodes(n.Dependencies) {
+		need := NeedContext{Result: statuses[dep], Outputs: outputs[dep]}
+		needs[dep.JobID] = need
+		needs[dep.ID] = need
+	}
+	return needs
+}
+
+// writeRetrySummary writes how many attempts every retried job and step needed
+func writeRetrySummary(w io.Writer, results []ResultNode) {
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].ID < results[j].ID
+	})
+
+	for _, result := range results {
+		if result.Report.Attempts > 1 {
+			fmt.Fprintf(w, "%s: job needed %d attempts\n", result.ID, result.Report.Attempts)
+		}
+
+		for i, step := range result.Report.Steps {
+			if step.Attempts > 1 {
+				fmt.Fprintf(w, "%s: step %s needed %d attempts\n", result.ID, stepLabel(i, Step{Name: step.Name}), step.Attempts)
+			}
+		}
+	}
+}
+
 // nextRunnableNodes finds a list of nodes from waitingNodes that can be run
 // in concurrent safely.
 func nextRunnableNodes(waitingNodes, doneNodes map[*Node]struct{}) []*Node {
@@ -31,53 +172,359 @@ outer:
 // Run builds a dependency graph based on given cfg, and will schedule jobs
 // to a pool of workers that will run these jobs concurrently.
 func Run(cfg Config, stdout, stderr io.Writer, maxWorkers uint64) error {
+	return RunWithOptions(cfg, RunOptions{
+		Stdout:     stdout,
+		Stderr:     stderr,
+		MaxWorkers: maxWorkers,
+	})
+}
+
+// RunWithOptions is similar to Run, but the scheduling behavior can be tweaked with opts.
+// When opts.KeepGoing is set and a job fails, the returned error will be a *RunError.
+//
+// When a job fails without opts.KeepGoing, or opts.Context gets cancelled, the running
+// jobs will be terminated and RunWithOptions will wait for them to exit before returning.
+//
+// Once the dependencies of a job have finished, its if expression decides whether it
+// runs or gets skipped. Without an if expression, a job only runs when all of its
+// dependencies succeeded. Jobs that run after a failure, e.g. with if: always(),
+// are only stopped by opts.Context.
+func RunWithOptions(cfg Config, opts RunOptions) (err error) {
 	graph, err := NewGraph(cfg)
 	if err != nil {
 		return err
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	if len(opts.Jobs) > 0 {
+		graph, err = graph.Prune(opts.Jobs)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.DryRun {
+		return WritePlan(opts.Stdout, graph)
+	}
+
+	mux, err := newOutputMux(opts, graph.Descendants())
+	if err != nil {
+		return err
+	}
+
+	if opts.ConfigName != "" {
+		opts.Events = opts.Events.withConfig(opts.ConfigName)
+	}
+
+	runStart := time.Now()
+	opts.Events.Emit(Event{Type: EventRunStarted})
+	defer func() {
+		opts.Events.Emit(Event{
+			Type:       EventRunFinished,
+			Status:     statusOf(err),
+			DurationMS: durationMS(time.Since(runStart)),
+			Error:      errorMessage(err),
+		})
+	}()
+
+	parentCtx := opts.Context
+	if parentCtx == nil {
+		parentCtx = context.Background()
+	}
+
+	// poolCtx controls the workers lifetime, while ctx controls the commands that
+	// the workers run. They're separated so that the workers are still available to
+	// report back after the commands have been terminated.
+	poolCtx, cancelPool := context.WithCancel(context.Background())
+	defer cancelPool()
+	ctx, cancel := context.WithCancel(parentCtx)
 	defer cancel()
-	doneNodes := make(map[*Node]struct{})
+
+	resolvedNodes := make(map[*Node]struct{})
 	waitingNodes := make(map[*Node]struct{})
+	statuses := make(map[*Node]string)
+	// failedUpstream contains the nodes that have a failed transitive dependency
+	failedUpstream := make(map[*Node]struct{})
+	outputs := make(map[*Node]map[string]string)
+	// hashes contains the hashes of the running jobs that have inputs
+	hashes := make(map[*Node]string)
+	state := stateStore{dir: opts.StateDir, config: cfg.path}
+	var runErr RunError
+	var firstErr error
+	var results []ResultNode
+	summaryOut := opts.Stderr
+	if summaryOut == nil {
+		summaryOut = opts.Stdout
+	}
+	defer func() {
+		writeRetrySummary(summaryOut, results)
+		if opts.JUnit != nil {
+			opts.JUnit.Add(opts.ConfigName, graph, results)
+		}
+	}()
 
 	queueSize := 1024
 	doneQueue := make(chan ResultNode, queueSize)
-	submit := PoolStart(ctx, maxWorkers)
-	submitNode := func(n *Node) {
+	submit := opts.Pool
+	if submit == nil {
+		submit = PoolStart(poolCtx, opts.MaxWorkers)
+	}
+	var running int
+	submitNode := func(n *Node, jobCtx context.Context) {
+		running++
+		opts.Events.Emit(Event{Type: EventJobQueued, Job: n.ID})
+		needsEnv := newNeedsEnv(n, outputs)
+		needs := newNeedsContext(n, statuses, outputs)
 		submit(func(worker Worker) {
-			worker.Stdout = stdout
-			worker.Stderr = stderr
+			out := mux.job(n)
+			worker.ctx = jobCtx
+			if opts.startJob != nil {
+				worker.ctx = opts.startJob(jobCtx, n.ID)
+			}
+			// worker.Env is shared between workers, so it's copied before appending
+			worker.Env = append(append([]string(nil), worker.Env...), needsEnv.Encode()...)
+			worker.Stdout = out.Stdout
+			worker.Stderr = out.Stderr
+			worker.GracePeriod = opts.GracePeriod
+			worker.Events = opts.Events
+			worker.Needs = needs
+			worker.CacheDir = opts.CacheDir
+			if opts.JUnit != nil {
+				worker.StderrTailSize = junitStderrTailSize
+			}
 			err := worker.Execute(n)
-			doneQueue <- ResultNode{n, err}
+			cancelled := err != nil && worker.ctx.Err() != nil && jobCtx.Err() == nil
+			doneQueue <- ResultNode{Node: n, Err: err, Report: worker.Report, output: out, service: worker.service, cancelled: cancelled}
 		})
 	}
 
+	// services contains the services that are ready, and still have dependents to serve
+	services := make(map[*Node]*service)
+	var servicesStopped sync.WaitGroup
+	defer servicesStopped.Wait()
+	stopService := func(n *Node) {
+		s, ok := services[n]
+		if !ok {
+			return
+		}
+
+		delete(services, n)
+		servicesStopped.Add(1)
+		go func() {
+			defer servicesStopped.Done()
+			s.stop()
+			opts.Events.Emit(Event{Type: EventServiceStopped, Job: n.ID})
+		}()
+	}
+	defer func() {
+		for n := range services {
+			stopService(n)
+		}
+	}()
+
+	// stopServedServices stops n and the dependencies of n when they're services
+	// whose dependents have all been resolved
+	stopServedServices := func(n *Node) {
+	outer:
+		for _, node := range append(sortedNodes(n.Dependencies), n) {
+			for dependent := range node.Dependents {
+				if _, ok := resolvedNodes[dependent]; !ok {
+					continue outer
+				}
+			}
+			stopService(node)
+		}
+	}
+
+	// resolve records the final status of n, and queues its dependents to be released
+	resolve := func(n *Node, status string) {
+		resolvedNodes[n] = struct{}{}
+		statuses[n] = status
+		_, failed := failedUpstream[n]
+		for dependent := range n.Dependents {
+			if failed || status == StatusFailure {
+				failedUpstream[dependent] = struct{}{}
+			}
+			waitingNodes[dependent] = struct{}{}
+		}
+		stopServedServices(n)
+	}
+
+	succeed := func(n *Node, nodeOutputs map[string]string) {
+		outputs[n] = nodeOutputs
+		// A service has to run again for its dependents when the run is resumed
+		if !n.Job.Service {
+			if err := opts.State.complete(n.ID, nodeOutputs); err != nil {
+				fmt.Fprintf(summaryOut, "%s: failed to update the run state: %v\n", n.ID, err)
+			}
+		}
+		resolve(n, StatusSuccess)
+	}
+
+	fail := func(n *Node, err error) {
+		if !opts.KeepGoing && firstErr == nil {
+			firstErr = err
+			cancel()
+		}
+
+		runErr.Failed = append(runErr.Failed, JobError{ID: n.ID, Err: err})
+		resolve(n, StatusFailure)
+	}
+
+	// failBeforeRun fails n that couldn't be submitted because of err
+	failBeforeRun := func(n *Node, err error) {
+		opts.Events.Emit(Event{Type: EventJobFinished, Job: n.ID, Status: StatusFailure, Error: err.Error()})
+		results = append(results, ResultNode{Node: n, Err: err})
+		fail(n, err)
+	}
+
+	// release decides whether every node whose dependencies have been resolved runs
+	// or gets skipped. Skipping a node can release its dependents, so it repeats
+	// until there's nothing left to release.
+	release := func() {
+		for {
+			runnableNodes := nextRunnableNodes(waitingNodes, resolvedNodes)
+			if len(runnableNodes) == 0 {
+				return
+			}
+
+			sort.Slice(runnableNodes, func(i, j int) bool {
+				return runnableNodes[i].ID < runnableNodes[j].ID
+			})
+			for _, runnableNode := range runnableNodes {
+				delete(waitingNodes, runnableNode)
+				if _, ok := resolvedNodes[runnableNode]; ok {
+					continue
+				}
+
+				_, failed := failedUpstream[runnableNode]
+				// The condition sees the same environment as the steps of the job
+				env := append(append(os.Environ(), newNeedsEnv(runnableNode, outputs).Encode()...), newJobEnv(runnableNode, 1).Encode()...)
+				run, err := evalCondition(runnableNode.Job.If, ExprContext{
+					Env:       envMap(env),
+					Matrix:    runnableNode.Matrix,
+					Needs:     newNeedsContext(runnableNode, statuses, outputs),
+					Success:   ctx.Err() == nil && dependenciesSucceeded(runnableNode, statuses),
+					Failure:   failed,
+					Cancelled: ctx.Err() != nil,
+				})
+				if err != nil {
+					failBeforeRun(runnableNode, fmt.Errorf("failed to evaluate if of %s job: %w", runnableNode.ID, err))
+					continue
+				}
+
+				// Once the run has been aborted, only the jobs that asked to run anyway,
+				// e.g. with always(), are started. They can't be interrupted by the abort.
+				if run && parentCtx.Err() == nil {
+					// A service is never up to date, since its dependents need it to run
+					if opts.StateDir != "" && len(runnableNode.Job.Inputs) > 0 && !runnableNode.Job.Service {
+						hash, err := hashJob(runnableNode, newNeedsEnv(runnableNode, outputs))
+						if err != nil {
+							failBeforeRun(runnableNode, fmt.Errorf("failed to hash the inputs of %s job: %w", runnableNode.ID, err))
+							continue
+						}
+
+						saved, ok := state.load(runnableNode.ID)
+						if ok && saved.Hash == hash && outputsExist(runnableNode.Job.Outputs) {
+							opts.Events.Emit(Event{Type: EventJobFinished, Job: runnableNode.ID, Status: StatusUpToDate})
+							fmt.Fprintf(summaryOut, "%s: job is up to date\n", runnableNode.ID)
+							succeed(runnableNode, saved.Outputs)
+							continue
+						}
+						hashes[runnableNode] = hash
+					}
+
+					jobCtx := ctx
+					if ctx.Err() != nil {
+						jobCtx = parentCtx
+					}
+					submitNode(runnableNode, jobCtx)
+					continue
+				}
+
+				opts.Events.Emit(Event{Type: EventJobFinished, Job: runnableNode.ID, Status: StatusSkipped})
+				if failed {
+					runErr.Skipped = append(runErr.Skipped, runnableNode.ID)
+				}
+				resolve(runnableNode, StatusSkipped)
+			}
+		}
+	}
+
+	for _, node := range graph.Descendants() {
+		if completedOutputs, ok := opts.State.isCompleted(node.ID); ok {
+			opts.Events.Emit(Event{Type: EventJobFinished, Job: node.ID, Status: StatusCompleted})
+			outputs[node] = completedOutputs
+			resolve(node, StatusSuccess)
+		}
+	}
+
 	for runnableNode := range graph.Dependents {
-		submitNode(runnableNode)
+		if _, ok := resolvedNodes[runnableNode]; !ok {
+			waitingNodes[runnableNode] = struct{}{}
+		}
 	}
+	release()
 
-	totalTasks := len(cfg.Jobs)
-	for len(doneNodes) < totalTasks {
+	for running > 0 {
 		result := <-doneQueue
-		if result.Err != nil {
-			return result.Err
+		running--
+		if err := result.output.Finish(result); err != nil && result.Err == nil {
+			result.Err = err
 		}
-
+		results = append(results, result)
 		node := result.Node
-		doneNodes[node] = struct{}{}
-		for dependent := range node.Dependents {
-			if _, ok := doneNodes[dependent]; !ok {
-				waitingNodes[dependent] = struct{}{}
+		status := statusOf(result.Err)
+		if result.cancelled {
+			status = StatusSkipped
+		}
+		opts.Events.Emit(Event{
+			Type:       EventJobFinished,
+			Job:        node.ID,
+			Attempt:    result.Report.Attempts,
+			Status:     status,
+			DurationMS: durationMS(result.Report.Duration),
+			Error:      errorMessage(result.Err),
+		})
+		if hash, ok := hashes[node]; ok {
+			var err error
+			if result.Err != nil {
+				err = state.remove(node.ID)
+			} else {
+				err = state.save(node.ID, jobState{Hash: hash, Outputs: result.Report.Outputs})
+			}
+
+			if err != nil {
+				fmt.Fprintf(summaryOut, "%s: failed to update the state: %v\n", node.ID, err)
 			}
 		}
 
-		runnableNodes := nextRunnableNodes(waitingNodes, doneNodes)
-		for _, runnableNode := range runnableNodes {
-			submitNode(runnableNode)
-			delete(waitingNodes, runnableNode)
+		if result.cancelled {
+			resolve(node, StatusSkipped)
+		} else if result.Err != nil {
+			fail(node, result.Err)
+		} else {
+			if result.service != nil {
+				services[node] = result.service
+			}
+			succeed(node, result.Report.Outputs)
 		}
+		release()
 	}
 
+	if err := parentCtx.Err(); err != nil {
+		return fmt.Errorf("run was interrupted: %w", err)
+	}
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	if len(runErr.Failed) > 0 {
+		sort.Slice(runErr.Failed, func(i, j int) bool {
+			return runErr.Failed[i].ID < runErr.Failed[j].ID
+		})
+		sort.Strings(runErr.Skipped)
+		return &runErr
+	}
 	return nil
 }
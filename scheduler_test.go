@@ -2,10 +2,34 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"os"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
+// syncBuffer is a bytes.Buffer that can be written by concurrent jobs safely
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
 func TestNextRunnableNodesAllReady(t *testing.T) {
 	node1 := &Node{ID: "node1"}
 	node2 := &Node{ID: "node2"}
@@ -209,3 +233,260 @@ func TestRunWithStepHasError(t *testing.T) {
 		t.Fatal("expected to get an error")
 	}
 }
+
+func TestRunWithKeepGoing(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{{Run: "exit 1"}}},
+			"job2": {Steps: []Step{{Run: "echo job2"}}, Needs: []string{"job1"}},
+			"job3": {Steps: []Step{{Run: "echo job3"}}},
+			"job4": {Steps: []Step{{Run: "echo job4"}}, Needs: []string{"job2", "job3"}},
+			"job5": {Steps: []Step{{Run: "echo job5"}}, Needs: []string{"job3"}},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, KeepGoing: true})
+	var runErr *RunError
+	if !errors.As(err, &runErr) {
+		t.Fatalf("expected to get a RunError, but got \"%v\"", err)
+	}
+
+	if len(runErr.Failed) != 1 || runErr.Failed[0].ID != "job1" {
+		t.Fatalf("expected only job1 to fail, but got %v", runErr.Failed)
+	}
+
+	expectedSkipped := []string{"job2", "job4"}
+	if strings.Join(runErr.Skipped, ",") != strings.Join(expectedSkipped, ",") {
+		t.Fatalf("expected %v to be skipped, but got %v", expectedSkipped, runErr.Skipped)
+	}
+
+	stdout := stdoutBuf.String()
+	for _, expected := range []string{"job3", "job5"} {
+		if !strings.Contains(stdout, expected) {
+			t.Fatalf("expected the output to contain %s, but got \"%s\"", expected, stdout)
+		}
+	}
+
+	for _, unexpected := range []string{"job2", "job4"} {
+		if strings.Contains(stdout, unexpected) {
+			t.Fatalf("expected the output to not contain %s, but got \"%s\"", unexpected, stdout)
+		}
+	}
+}
+
+func TestRunWithRetrySummary(t *testing.T) {
+	steps := []Step{{Name: "flaky", Run: `test "$GOTOPUS_ATTEMPT" -ge 2`, Retry: Retry{Attempts: 2}}}
+	cfg := Config{
+		Jobs: map[string]Job{"job1": {Steps: steps}},
+	}
+
+	var stdoutBuf, stderrBuf bytes.Buffer
+	err := Run(cfg, &stdoutBuf, &stderrBuf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "job1: step \"flaky\" needed 2 attempts\n"
+	if stderr := stderrBuf.String(); stderr != expected {
+		t.Fatalf("expected the error output to be \"%s\", but got \"%s\"", expected, stderr)
+	}
+}
+
+func TestRunWithCancelledContext(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{{Run: "sleep 30"}}},
+			"job2": {Steps: []Step{{Run: "echo job2"}}, Needs: []string{"job1"}},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+
+	var stdoutBuf syncBuffer
+	start := time.Now()
+	err := RunWithOptions(cfg, RunOptions{Context: ctx, Stdout: &stdoutBuf})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the run to be interrupted, but got \"%v\"", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second*2 {
+		t.Fatalf("expected the run to stop right away, but it took %f seconds", elapsed.Seconds())
+	}
+
+	if stdout := stdoutBuf.String(); strings.Contains(stdout, "job2") {
+		t.Fatalf("expected job2 to never run, but got \"%s\"", stdout)
+	}
+}
+
+func TestRunWithSelectedJobs(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {Steps: []Step{{Run: "echo job1"}}},
+			"job2": {Steps: []Step{{Run: "echo job2"}}, Needs: []string{"job1"}},
+			"job3": {Steps: []Step{{Run: "echo job3"}}},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, Jobs: []string{"job2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "job1\njob2\n"
+	if stdout := stdoutBuf.String(); stdout != expected {
+		t.Fatalf("expected the output to be \"%s\", but got \"%s\"", expected, stdout)
+	}
+}
+
+func TestRunWithMatrix(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"test": {
+				Strategy: Strategy{Matrix: Matrix{Values: map[string][]string{"go": {"1.20", "1.21"}}}},
+				Steps:    []Step{{Run: "echo $GOTOPUS_JOB_ID $GOTOPUS_MATRIX_GO"}},
+			},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := Run(cfg, &stdoutBuf, &stdoutBuf, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdoutBuf.String()), "\n")
+	sort.Strings(lines)
+	expected := "test(go=1.20) 1.20,test(go=1.21) 1.21"
+	if actual := strings.Join(lines, ","); actual != expected {
+		t.Fatalf("expected the output to be \"%s\", but got \"%s\"", expected, actual)
+	}
+}
+
+func TestRunWithOutputs(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {Steps: []Step{
+				{Run: `echo "version=1.2.3" >> "$GOTOPUS_OUTPUT"`},
+				{Run: `echo "commit=abc" >> "$GOTOPUS_OUTPUT"`},
+			}},
+			"deploy": {
+				Needs: []string{"build"},
+				Steps: []Step{{Run: "echo $GOTOPUS_NEEDS_BUILD_VERSION $GOTOPUS_NEEDS_BUILD_COMMIT"}},
+			},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := Run(cfg, &stdoutBuf, &stdoutBuf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := stdoutBuf.String(); actual != "1.2.3 abc\n" {
+		t.Fatalf("expected the output to be \"1.2.3 abc\", but got \"%s\"", actual)
+	}
+}
+
+func TestRunWithConditions(t *testing.T) {
+	os.Setenv("GOTOPUS_TEST_BRANCH", "dev")
+	defer os.Unsetenv("GOTOPUS_TEST_BRANCH")
+
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {Steps: []Step{{Run: `echo "version=1.2.3" >> "$GOTOPUS_OUTPUT"`}}},
+			"deploy": {
+				Needs: []string{"build"},
+				If:    "env.GOTOPUS_TEST_BRANCH == 'main'",
+				Steps: []Step{{Run: "echo deploy"}},
+			},
+			"notify": {
+				Needs: []string{"deploy"},
+				Steps: []Step{{Run: "echo notify"}},
+			},
+			"release": {
+				Needs: []string{"build"},
+				If:    "needs.build.outputs.version == '1.2.3'",
+				Steps: []Step{{Run: "echo release"}},
+			},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := Run(cfg, &stdoutBuf, &stdoutBuf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := stdoutBuf.String(); actual != "release\n" {
+		t.Fatalf("expected only release to run, but got \"%s\"", actual)
+	}
+}
+
+func TestRunWithAlwaysAfterFailure(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"test":    {Steps: []Step{{Run: "exit 1"}}},
+			"deploy":  {Needs: []string{"test"}, Steps: []Step{{Run: "echo deploy"}}},
+			"report":  {Needs: []string{"test"}, If: "failure()", Steps: []Step{{Run: "echo report"}}},
+			"cleanup": {Needs: []string{"deploy"}, If: "always()", Steps: []Step{{Run: "echo cleanup"}}},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := Run(cfg, &stdoutBuf, &stdoutBuf, 0)
+	if err == nil {
+		t.Fatal("expected to get an error")
+	}
+
+	lines := strings.Split(strings.TrimSpace(stdoutBuf.String()), "\n")
+	sort.Strings(lines)
+	if actual := strings.Join(lines, ","); actual != "cleanup,report" {
+		t.Fatalf("expected only cleanup and report to run, but got \"%s\"", actual)
+	}
+}
+
+func TestRunWithConditionsOnJobEnv(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {Steps: []Step{{Run: `echo "version=1.2.3" >> "$GOTOPUS_OUTPUT"`}}},
+			"deploy": {
+				Needs:    []string{"build"},
+				Strategy: Strategy{Matrix: Matrix{Values: map[string][]string{"os": {"linux", "darwin"}}}},
+				Env:      map[string]string{"TARGET": "prod"},
+				If:       "env.TARGET == 'prod' && env.GOTOPUS_MATRIX_OS == 'linux' && env.GOTOPUS_NEEDS_BUILD_VERSION == '1.2.3'",
+				Steps:    []Step{{Run: "echo deploy $GOTOPUS_MATRIX_OS"}},
+			},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := Run(cfg, &stdoutBuf, &stdoutBuf, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := stdoutBuf.String(); actual != "deploy linux\n" {
+		t.Fatalf("expected only the linux deploy job to run, but got \"%s\"", actual)
+	}
+}
+
+func TestRunWithInvalidCondition(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"job1": {If: "env.BRANCH ==", Steps: []Step{{Run: "echo job1"}}},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := Run(cfg, &stdoutBuf, &stdoutBuf, 0)
+	if err == nil {
+		t.Fatal("expected to get an error due to an invalid if")
+	}
+
+	if stdoutBuf.String() != "" {
+		t.Fatalf("expected nothing to run, but got \"%s\"", stdoutBuf.String())
+	}
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultReadinessInterval = time.Second
+	defaultReadinessTimeout  = time.Minute
+	// readinessProbeTimeout is how long a single probe can take, unless the service
+	// has to be ready sooner than that
+	readinessProbeTimeout = time.Second * 10
+)
+
+// service is the last step of a service job that keeps running in the background
+type service struct {
+	cancel context.CancelFunc
+	// exited is closed once the command has exited, and err is set to how it exited
+	exited chan struct{}
+	err    error
+}
+
+// stop terminates the service gracefully, and waits for it to exit
+func (s *service) stop() error {
+	s.cancel()
+	<-s.exited
+	return s.err
+}
+
+// isSet returns true when one of the probes is set
+func (r Readiness) isSet() bool {
+	return r.TCP != "" || r.HTTP != "" || r.Exec != ""
+}
+
+// String describes the probe, e.g. tcp localhost:5432
+func (r Readiness) String() string {
+	switch {
+	case r.TCP != "":
+		return "tcp " + r.TCP
+	case r.HTTP != "":
+		return "http " + r.HTTP
+	}
+	return "exec " + r.Exec
+}
+
+// validateService returns an error when job has an incomplete service definition
+func validateService(id string, job Job) error {
+	if !job.Service {
+		if job.Readiness.isSet() {
+			return fmt.Errorf("%s job has a readiness probe, but it isn't a service", id)
+		}
+		return nil
+	}
+
+	if len(job.Steps) == 0 {
+		return fmt.Errorf("%s job is a service, but it doesn't have any steps", id)
+	}
+
+	var probes int
+	for _, probe := range []string{job.Readiness.TCP, job.Readiness.HTTP, job.Readiness.Exec} {
+		if probe != "" {
+			probes++
+		}
+	}
+
+	if probes != 1 {
+		return fmt.Errorf("%s job is a service, so its readiness needs exactly one of tcp, http, or exec", id)
+	}
+	return nil
+}
+
+// probe checks once whether the service is ready. A probe can't take longer than timeout.
+func (r Readiness) probe(ctx context.Context, env []string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	switch {
+	case r.TCP != "":
+		var dialer net.Dialer
+		conn, err := dialer.DialContext(ctx, "tcp", r.TCP)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case r.HTTP != "":
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.HTTP, nil)
+		if err != nil {
+			return err
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+
+		if res.StatusCode >= 400 {
+			return fmt.Errorf("%s responded with %s", r.HTTP, res.Status)
+		}
+		return nil
+	}
+
+	cmd := executeCmd(r.Exec)
+	cmd.Env = env
+	return runCmd(ctx, cmd, 0)
+}
+
+// wait repeats the probe until it passes. It fails when the service has exited,
+// the service isn't ready in time, or ctx is done.
+func (r Readiness) wait(ctx context.Context, env []string, s *service) error {
+	interval := r.Interval
+	if interval <= 0 {
+		interval = defaultReadinessInterval
+	}
+
+	timeout := r.Timeout
+	if timeout <= 0 {
+		timeout = defaultReadinessTimeout
+	}
+
+	readyBy := time.Now().Add(timeout)
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// The probe may pass because of something else, so an exited service is never ready
+		select {
+		case <-s.exited:
+			if s.err == nil {
+				return errors.New("exited before it was ready")
+			}
+			return fmt.Errorf("exited before it was ready: %w", s.err)
+		default:
+		}
+
+		probeTimeout := time.Until(readyBy)
+		if probeTimeout > readinessProbeTimeout {
+			probeTimeout = readinessProbeTimeout
+		}
+
+		err := r.probe(ctx, env, probeTimeout)
+		if err == nil {
+			return nil
+		}
+
+		select {
+		case <-s.exited:
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline.C:
+			return fmt.Errorf("wasn't ready after %s: %w", timeout, err)
+		case <-ticker.C:
+		}
+	}
+}
+
+// startService starts the i-th step of n in the background, and waits until the
+// service is ready. Once the service is ready, it's kept in w.service. The service
+// is only stopped by w.ctx, or by stopping it, so it outlives the job timeout.
+func (w *Worker) startService(ctx context.Context, n *Node, i int, attempt int, env []string, report *StepReport) error {
+	step := n.Job.Steps[i]
+	w.Events.Emit(Event{
+		Type:     EventStepStarted,
+		Job:      n.ID,
+		Step:     i + 1,
+		StepName: step.Name,
+		WorkerID: &w.id,
+		Attempt:  attempt,
+	})
+	start := time.Now()
+	cmd := executeCmd(step.Run)
+	cmd.Env = env
+	cmd.Stdout = w.Stdout
+	cmd.Stderr = w.Stderr
+
+	serviceCtx, cancel := context.WithCancel(w.ctx)
+	s := &service{cancel: cancel, exited: make(chan struct{})}
+	go func() {
+		s.err = runCmd(serviceCtx, cmd, w.GracePeriod)
+		close(s.exited)
+	}()
+
+	err := n.Job.Readiness.wait(ctx, env, s)
+	if err != nil && ctx.Err() != nil {
+		// The job timed out or got cancelled, which is reported by the job
+		s.stop()
+		err = ctx.Err()
+	} else if err != nil {
+		s.stop()
+		err = fmt.Errorf("service %s %w", n.ID, err)
+	} else {
+		w.service = s
+	}
+
+	// The exit code is only known when the service has exited
+	var code *int
+	if err != nil {
+		c := exitCode(cmd)
+		code = &c
+		report.ExitCode = c
+	}
+	report.Duration += time.Since(start)
+	w.Events.Emit(Event{
+		Type:       EventStepFinished,
+		Job:        n.ID,
+		Step:       i + 1,
+		StepName:   step.Name,
+		WorkerID:   &w.id,
+		Attempt:    attempt,
+		Status:     statusOf(err),
+		ExitCode:   code,
+		DurationMS: durationMS(time.Since(start)),
+		Error:      errorMessage(err),
+	})
+	return err
+}
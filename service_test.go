@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateService(t *testing.T) {
+	tests := []struct {
+		job      Job
+		expected string
+	}{
+		{Job{Service: true, Steps: []Step{{Run: "postgres"}}, Readiness: Readiness{TCP: "localhost:5432"}}, ""},
+		{Job{Steps: []Step{{Run: "make"}}}, ""},
+		{Job{Service: true, Readiness: Readiness{TCP: "localhost:5432"}}, "db job is a service, but it doesn't have any steps"},
+		{Job{Service: true, Steps: []Step{{Run: "postgres"}}}, "db job is a service, so its readiness needs exactly one of tcp, http, or exec"},
+		{Job{Service: true, Steps: []Step{{Run: "postgres"}}, Readiness: Readiness{TCP: "localhost:5432", Exec: "pg_isready"}}, "db job is a service, so its readiness needs exactly one of tcp, http, or exec"},
+		{Job{Steps: []Step{{Run: "postgres"}}, Readiness: Readiness{Exec: "pg_isready"}}, "db job has a readiness probe, but it isn't a service"},
+	}
+
+	for _, test := range tests {
+		err := validateService("db", test.job)
+		if test.expected == "" && err != nil {
+			t.Fatalf("expected %+v to be valid, but got %v", test.job, err)
+		}
+
+		if test.expected != "" && (err == nil || err.Error() != test.expected) {
+			t.Fatalf("expected the error to be \"%s\", but got %v", test.expected, err)
+		}
+	}
+}
+
+func TestReadinessProbe(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/healthz" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	tests := []struct {
+		readiness Readiness
+		ready     bool
+	}{
+		{Readiness{TCP: listener.Addr().String()}, true},
+		{Readiness{TCP: closed.Addr().String()}, false},
+		{Readiness{HTTP: server.URL + "/healthz"}, true},
+		{Readiness{HTTP: server.URL + "/missing"}, false},
+		{Readiness{Exec: "exit 0"}, true},
+		{Readiness{Exec: "exit 1"}, false},
+	}
+
+	for _, test := range tests {
+		err := test.readiness.probe(context.Background(), nil, time.Second)
+		if test.ready && err != nil {
+			t.Fatalf("expected %s to pass, but got %v", test.readiness, err)
+		}
+
+		if !test.ready && err == nil {
+			t.Fatalf("expected %s to fail", test.readiness)
+		}
+	}
+}
+
+func TestRunWithService(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ready := filepath.Join(dir, "ready")
+	stopped := filepath.Join(dir, "stopped")
+	cfg := Config{
+		Jobs: map[string]Job{
+			"db": {
+				Service: true,
+				Steps: []Step{
+					{Run: "echo migrated"},
+					{Run: "trap 'touch " + stopped + "; exit 0' TERM; touch " + ready + "; while true; do sleep 0.05; done"},
+				},
+				Readiness: Readiness{Exec: "test -e " + ready, Interval: time.Millisecond * 10},
+			},
+			"test": {
+				Needs: []string{"db"},
+				Steps: []Step{{Run: "test -e " + stopped + " || echo db is running"}},
+			},
+		},
+	}
+
+	// The shell may report that sleep got terminated along with the service
+	var stdoutBuf, stderrBuf syncBuffer
+	err = RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, Stderr: &stderrBuf, GracePeriod: time.Second * 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if actual := stdoutBuf.String(); actual != "migrated\ndb is running\n" {
+		t.Fatalf("expected test to run while db is running, but got \"%s\"", actual)
+	}
+
+	if _, err := os.Stat(stopped); err != nil {
+		t.Fatalf("expected db to be stopped once test finished, but got %v", err)
+	}
+}
+
+func TestRunWithServicePrefixedOutput(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"db": {
+				Service:   true,
+				Steps:     []Step{{Run: "while true; do echo db is running; sleep 0.01; done"}},
+				Readiness: Readiness{Exec: "true", Interval: time.Millisecond * 10},
+			},
+			"test1": {
+				Needs: []string{"db"},
+				Steps: []Step{{Run: "sleep 0.1; echo test1"}},
+			},
+			"test2": {
+				Needs: []string{"test1"},
+				Steps: []Step{{Run: "sleep 0.1; echo test2"}},
+			},
+		},
+	}
+
+	// The service keeps writing while the run flushes the output of its job
+	var stdoutBuf syncBuffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, Output: OutputPrefixed, GracePeriod: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range strings.Split(strings.TrimSuffix(stdoutBuf.String(), "\n"), "\n") {
+		if line != "[db] db is running" && line != "[test1] test1" && line != "[test2] test2" {
+			t.Fatalf("expected every line to be prefixed, but got \"%s\"", line)
+		}
+	}
+}
+
+func TestRunWithServiceSlowProbe(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"db": {
+				Service:   true,
+				Steps:     []Step{{Run: "sleep 10"}},
+				Readiness: Readiness{Exec: "sleep 0.2", Interval: time.Millisecond * 10},
+			},
+			"test": {
+				Needs: []string{"db"},
+				Steps: []Step{{Run: "echo test"}},
+			},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, GracePeriod: time.Second})
+	if err != nil {
+		t.Fatalf("expected a probe to be able to take longer than the interval, but got %v", err)
+	}
+
+	if actual := stdoutBuf.String(); actual != "test\n" {
+		t.Fatalf("expected test to run, but got \"%s\"", actual)
+	}
+}
+
+func TestRunWithServiceExitedBeforeReady(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"db": {
+				Service:   true,
+				Steps:     []Step{{Run: "exit 3"}},
+				Readiness: Readiness{Exec: "exit 1", Interval: time.Millisecond * 10},
+			},
+			"test": {
+				Needs: []string{"db"},
+				Steps: []Step{{Run: "echo test"}},
+			},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf})
+	if err == nil || !strings.Contains(err.Error(), "service db exited before it was ready: exit status 3") {
+		t.Fatalf("expected db to fail for exiting early, but got %v", err)
+	}
+
+	if actual := stdoutBuf.String(); actual != "" {
+		t.Fatalf("expected test to not run, but got \"%s\"", actual)
+	}
+}
+
+func TestRunWithServiceNotReady(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"db": {
+				Service:   true,
+				Steps:     []Step{{Run: "sleep 10"}},
+				Readiness: Readiness{Exec: "exit 1", Interval: time.Millisecond * 10, Timeout: time.Millisecond * 100},
+			},
+		},
+	}
+
+	var stdoutBuf syncBuffer
+	start := time.Now()
+	err := RunWithOptions(cfg, RunOptions{Stdout: &stdoutBuf, GracePeriod: time.Second})
+	if err == nil || !strings.Contains(err.Error(), "service db wasn't ready after 100ms") {
+		t.Fatalf("expected db to fail for not being ready, but got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("expected db to be stopped, but the run took %s", elapsed)
+	}
+}
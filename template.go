@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// ParamString is a parameter that takes any value
+	ParamString = "string"
+	// ParamNumber is a parameter that takes a number, e.g. 1.5
+	ParamNumber = "number"
+	// ParamBoolean is a parameter that takes true or false
+	ParamBoolean = "boolean"
+)
+
+// Template is the shape of jobs that are only different in their parameters. Every
+// ${{ expression }} in the name, the env, and the names, runs, and envs of the steps
+// is replaced with its value, where params.NAME is the argument of a job. For example:
+//
+//	templates:
+//	  build-service:
+//	    params:
+//	      dir:
+//	        type: string
+//	    name: build ${{ params.dir }}
+//	    steps:
+//	      - run: make -C ${{ params.dir }}
+//	jobs:
+//	  api:
+//	    uses: build-service
+//	    with:
+//	      dir: services/api
+type Template struct {
+	// Params are the parameters that the jobs pass their arguments to with With
+	Params map[string]Param `yaml:"params"`
+	// Name is a human-friendly name of the jobs
+	Name string `yaml:"name"`
+	// Env is a user-space environment for every step
+	Env map[string]string `yaml:"env"`
+	// Steps represent a list of commands that will be executed sequentially
+	Steps []Step `yaml:"steps"`
+	// Timeout limits how long the whole job can run. If 0, the job can run forever
+	Timeout time.Duration `yaml:"timeout"`
+	// Retry re-runs the whole job when any of its steps fails
+	Retry Retry `yaml:"retry"`
+
+	// position is where the template is defined, when it was decoded from a config
+	position Position
+}
+
+// Param is a typed parameter of a template
+type Param struct {
+	// Type is either ParamString, ParamNumber, or ParamBoolean. If empty, it's ParamString
+	Type string `yaml:"type"`
+	// Default is used when a job doesn't pass an argument. If nil, the parameter is required
+	Default *string `yaml:"default"`
+	// Description tells what the parameter is for
+	Description string `yaml:"description"`
+}
+
+// parse converts value to the type of p, so that it can be compared in expressions
+func (p Param) parse(value string) (interface{}, error) {
+	switch p.Type {
+	case "", ParamString:
+		return value, nil
+	case ParamNumber:
+		n, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a number", value)
+		}
+		return n, nil
+	case ParamBoolean:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q isn't a boolean", value)
+		}
+		return b, nil
+	}
+	return nil, fmt.Errorf("unknown type %s, it has to be string, number, or boolean", p.Type)
+}
+
+// validateTemplate returns an error when template name has an invalid parameter,
+// or an expression that refers to something else than its parameters
+func validateTemplate(name string, t Template) error {
+	for _, paramName := range t.paramNames() {
+		param := t.Params[paramName]
+		switch param.Type {
+		case "", ParamString, ParamNumber, ParamBoolean:
+		default:
+			return fmt.Errorf("%s param of %s template has an unknown type %s, it has to be string, number, or boolean", paramName, name, param.Type)
+		}
+
+		if param.Default != nil {
+			if _, err := param.parse(*param.Default); err != nil {
+				return fmt.Errorf("%s param of %s template has an invalid default: %v", paramName, name, err)
+			}
+		}
+	}
+
+	if len(t.Steps) == 0 {
+		return fmt.Errorf("%s template doesn't have any steps", name)
+	}
+
+	for _, s := range t.strings() {
+		err := scanInterpolation(s, func(text string, expr *Expr) error {
+			if expr == nil {
+				return nil
+			}
+
+			for context, properties := range expr.contextRefs() {
+				if context != "params" {
+					return fmt.Errorf("it can only refer to params, but it refers to %s", context)
+				}
+
+				for _, property := range properties {
+					if _, ok := t.Params[property]; !ok {
+						return fmt.Errorf("it doesn't have %s param", property)
+					}
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("%s template has an invalid expression: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// paramNames returns the names of the parameters of t in sorted order
+func (t Template) paramNames() []string {
+	names := make([]string, 0, len(t.Params))
+	for name := range t.Params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// strings returns every string of t where expressions are replaced
+func (t Template) strings() []string {
+	s := append([]string{t.Name}, mapValues(t.Env)...)
+	for _, step := range t.Steps {
+		s = append(s, step.Name, step.Run)
+		s = append(s, mapValues(step.Env)...)
+	}
+	return s
+}
+
+// mapKeys returns the keys of m in sorted order
+func mapKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// mapValues returns the values of m sorted by their keys
+func mapValues(m map[string]string) []string {
+	var values []string
+	for _, k := range mapKeys(m) {
+		values = append(values, m[k])
+	}
+	return values
+}
+
+// expand returns job id with the name, env, steps, timeout, and retry from t, where
+// the expressions are replaced with the arguments of the job. The returned job
+// doesn't use a template anymore.
+func (t Template) expand(id string, job Job) (Job, error) {
+	params := make(map[string]interface{}, len(t.Params))
+	for _, name := range mapKeys(job.With) {
+		param, ok := t.Params[name]
+		if !ok {
+			return job, fmt.Errorf("%s job passes %s to %s template, but the template doesn't have that param", id, name, job.Uses)
+		}
+
+		value, err := param.parse(job.With[name])
+		if err != nil {
+			return job, fmt.Errorf("%s job passes an invalid %s to %s template: %v", id, name, job.Uses, err)
+		}
+		params[name] = value
+	}
+
+	for _, name := range t.paramNames() {
+		if _, ok := params[name]; ok {
+			continue
+		}
+
+		param := t.Params[name]
+		if param.Default == nil {
+			return job, fmt.Errorf("%s job doesn't pass %s to %s template, but it's required", id, name, job.Uses)
+		}
+
+		value, err := param.parse(*param.Default)
+		if err != nil {
+			return job, err
+		}
+		params[name] = value
+	}
+
+	ctx := ExprContext{Params: params}
+	var err error
+	replace := func(s string) string {
+		if err != nil {
+			return s
+		}
+
+		var replaced string
+		replaced, err = interpolate(s, ctx)
+		return replaced
+	}
+	replaceEnv := func(env map[string]string) map[string]string {
+		if env == nil {
+			return nil
+		}
+
+		replaced := make(map[string]string, len(env))
+		for k, v := range env {
+			replaced[k] = replace(v)
+		}
+		return replaced
+	}
+
+	if job.Name == "" {
+		job.Name = t.Name
+	}
+	job.Name = replace(job.Name)
+
+	env := replaceEnv(t.Env)
+	for k, v := range replaceEnv(job.Env) {
+		if env == nil {
+			env = make(map[string]string)
+		}
+		env[k] = v
+	}
+	job.Env = env
+
+	job.Steps = make([]Step, len(t.Steps))
+	for i, step := range t.Steps {
+		step.Name = replace(step.Name)
+		step.Run = replace(step.Run)
+		step.Env = replaceEnv(step.Env)
+		job.Steps[i] = step
+	}
+
+	if job.Timeout == 0 {
+		job.Timeout = t.Timeout
+	}
+
+	if job.Retry.Attempts == 0 {
+		job.Retry = t.Retry
+	}
+
+	if err != nil {
+		return job, fmt.Errorf("%s job failed to expand %s template: %w", id, job.Uses, err)
+	}
+
+	job.Uses = ""
+	job.With = nil
+	return job, nil
+}
+
+// expandTemplates replaces every job of cfg that uses a template with its expanded
+// job. It's only needed for configs that weren't loaded by NewConfig.
+func expandTemplates(cfg Config) (Config, error) {
+	expanded := false
+	for _, job := range cfg.Jobs {
+		expanded = expanded || job.Uses != ""
+	}
+
+	if !expanded {
+		return cfg, nil
+	}
+
+	l := newConfigLoader()
+	for id, job := range cfg.Jobs {
+		l.jobs[id] = job
+	}
+
+	for name, t := range cfg.Templates {
+		l.templates[name] = t
+	}
+
+	l.expandTemplates()
+	if len(l.problems) > 0 {
+		// The jobs weren't decoded, so their problems don't have positions, and they're
+		// sorted by their messages, which start with the job IDs
+		messages := make([]string, 0, len(l.problems))
+		for _, problem := range l.problems {
+			messages = append(messages, problem.Message)
+		}
+		sort.Strings(messages)
+		return cfg, errors.New(strings.Join(messages, "\n"))
+	}
+
+	cfg.Jobs = l.jobs
+	return cfg, nil
+}
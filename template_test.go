@@ -0,0 +1,227 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParamParse(t *testing.T) {
+	tests := []struct {
+		param    Param
+		value    string
+		expected interface{}
+	}{
+		{Param{}, "services/api", "services/api"},
+		{Param{Type: ParamString}, "1", "1"},
+		{Param{Type: ParamNumber}, "1.5", 1.5},
+		{Param{Type: ParamBoolean}, "true", true},
+		{Param{Type: ParamNumber}, "many", nil},
+		{Param{Type: ParamBoolean}, "yes please", nil},
+		{Param{Type: "list"}, "a", nil},
+	}
+
+	for _, test := range tests {
+		actual, err := test.param.parse(test.value)
+		if test.expected == nil && err == nil {
+			t.Fatalf("expected %s to be invalid for %+v", test.value, test.param)
+		}
+
+		if actual != test.expected {
+			t.Fatalf("expected %s to be %v, but got %v", test.value, test.expected, actual)
+		}
+	}
+}
+
+func TestValidateTemplate(t *testing.T) {
+	def := "maybe"
+	tests := []struct {
+		template Template
+		expected string
+	}{
+		{Template{Params: map[string]Param{"dir": {}}, Steps: []Step{{Run: "make -C ${{ params.dir }}"}}}, ""},
+		{Template{Params: map[string]Param{"dir": {Type: "path"}}, Steps: []Step{{Run: "make"}}}, "dir param of build template has an unknown type path, it has to be string, number, or boolean"},
+		{Template{Params: map[string]Param{"race": {Type: ParamBoolean, Default: &def}}, Steps: []Step{{Run: "make"}}}, `race param of build template has an invalid default: "maybe" isn't a boolean`},
+		{Template{}, "build template doesn't have any steps"},
+		{Template{Steps: []Step{{Run: "make -C ${{ params.dir }}"}}}, "build template has an invalid expression: it doesn't have dir param"},
+		{Template{Env: map[string]string{"OS": "${{ matrix.os }}"}, Steps: []Step{{Run: "make"}}}, "build template has an invalid expression: it can only refer to params, but it refers to matrix"},
+	}
+
+	for _, test := range tests {
+		err := validateTemplate("build", test.template)
+		if test.expected == "" && err != nil {
+			t.Fatalf("expected %+v to be valid, but got %v", test.template, err)
+		}
+
+		if test.expected != "" && (err == nil || err.Error() != test.expected) {
+			t.Fatalf("expected the error to be \"%s\", but got %v", test.expected, err)
+		}
+	}
+}
+
+func TestTemplateExpand(t *testing.T) {
+	shards := "1"
+	template := Template{
+		Params: map[string]Param{
+			"dir":    {},
+			"race":   {Type: ParamBoolean},
+			"shards": {Type: ParamNumber, Default: &shards},
+		},
+		Name:    "build ${{ params.dir }}",
+		Env:     map[string]string{"DIR": "${{ params.dir }}", "CGO_ENABLED": "0"},
+		Timeout: time.Minute,
+		Steps: []Step{
+			{Name: "test ${{ params.dir }}", Run: "go test ${{ params.race && '-race' || '' }} -shards=${{ params.shards }} ./${{ params.dir }}/..."},
+		},
+	}
+
+	job := Job{
+		Uses:  "build-service",
+		With:  map[string]string{"dir": "api", "race": "true"},
+		Env:   map[string]string{"CGO_ENABLED": "1"},
+		Needs: []string{"setup"},
+	}
+
+	expanded, err := template.expand("api", job)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if expanded.Name != "build api" || expanded.Timeout != time.Minute || expanded.Uses != "" {
+		t.Fatalf("expected the job to be expanded, but got %+v", expanded)
+	}
+
+	if !reflect.DeepEqual(expanded.Env, map[string]string{"DIR": "api", "CGO_ENABLED": "1"}) {
+		t.Fatalf("expected the env of the job to override the template, but got %v", expanded.Env)
+	}
+
+	step := expanded.Steps[0]
+	if step.Name != "test api" || step.Run != "go test -race -shards=1 ./api/..." {
+		t.Fatalf("expected the params to be replaced in the step, but got %+v", step)
+	}
+
+	if !reflect.DeepEqual(expanded.Needs, []string{"setup"}) {
+		t.Fatalf("expected the needs to be kept, but got %v", expanded.Needs)
+	}
+
+	if template.Steps[0].Name != "test ${{ params.dir }}" {
+		t.Fatal("expected the template to be left unchanged")
+	}
+}
+
+func TestTemplateExpandInvalidArguments(t *testing.T) {
+	template := Template{
+		Params: map[string]Param{"dir": {}, "shards": {Type: ParamNumber}},
+		Steps:  []Step{{Run: "make -C ${{ params.dir }}"}},
+	}
+
+	tests := []struct {
+		with     map[string]string
+		expected string
+	}{
+		{map[string]string{"dir": "api"}, "api job doesn't pass shards to build-service template, but it's required"},
+		{map[string]string{"dir": "api", "shards": "two"}, `api job passes an invalid shards to build-service template: "two" isn't a number`},
+		{map[string]string{"dir": "api", "shards": "2", "race": "true"}, "api job passes race to build-service template, but the template doesn't have that param"},
+	}
+
+	for _, test := range tests {
+		_, err := template.expand("api", Job{Uses: "build-service", With: test.with})
+		if err == nil || err.Error() != test.expected {
+			t.Fatalf("expected the error to be \"%s\", but got %v", test.expected, err)
+		}
+	}
+}
+
+func TestNewGraphWithTemplates(t *testing.T) {
+	cfg := Config{
+		Templates: map[string]Template{
+			"build-service": {
+				Params: map[string]Param{"dir": {}},
+				Steps:  []Step{{Run: "make -C ${{ params.dir }}"}},
+			},
+		},
+		Jobs: map[string]Job{
+			"api": {Uses: "build-service", With: map[string]string{"dir": "api"}},
+		},
+	}
+
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := graph.Descendants()
+	if len(nodes) != 1 || nodes[0].Job.Steps[0].Run != "make -C api" {
+		t.Fatalf("expected api to be expanded, but got %+v", nodes)
+	}
+
+	cfg.Jobs["web"] = Job{Uses: "build-website"}
+	if _, err := NewGraph(cfg); err == nil || err.Error() != "web job uses build-website template, but it doesn't exist" {
+		t.Fatalf("expected to get an error due to a missing template, but got %v", err)
+	}
+
+	cfg.Jobs["docs"] = Job{Uses: "build-docs"}
+	expected := "docs job uses build-docs template, but it doesn't exist\nweb job uses build-website template, but it doesn't exist"
+	if _, err := NewGraph(cfg); err == nil || err.Error() != expected {
+		t.Fatalf("expected the error to be \"%s\", but got \"%v\"", expected, err)
+	}
+}
+
+func TestNewConfigWithTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	configRaw := `include:
+  - shared.yaml
+templates:
+  build-service:
+    params:
+      dir:
+        type: string
+    name: build ${{ params.dir }}
+    steps:
+      - run: make -C services/${{ params.dir }}
+jobs:
+  api:
+    uses: build-service
+    with:
+      dir: api
+  web:
+    uses: shared/deploy
+    with:
+      target: web`
+	writeConfigs(t, dir, map[string]string{
+		"ci.yaml": configRaw,
+		"shared.yaml": `templates:
+  deploy:
+    params:
+      target:
+        type: string
+    steps:
+      - run: ./deploy.sh ${{ params.target }}`,
+	})
+
+	ci := filepath.Join(dir, "ci.yaml")
+	cfg, err := NewConfig(ci)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job := cfg.Jobs["api"]; job.Name != "build api" || job.Steps[0].Run != "make -C services/api" {
+		t.Fatalf("expected api to be expanded, but got %+v", job)
+	}
+
+	if job := cfg.Jobs["web"]; job.Steps[0].Run != "./deploy.sh web" {
+		t.Fatalf("expected web to be expanded with the included template, but got %+v", job)
+	}
+
+	writeConfigs(t, dir, map[string]string{"ci.yaml": configRaw + "\n  worker:\n    uses: build-servce\n"})
+	_, err = NewConfig(ci)
+	expectProblems(t, err, ci+":21:11: worker job uses build-servce template, but it doesn't exist")
+}
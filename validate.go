@@ -0,0 +1,450 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// jobIDPattern is what a job ID written in a config looks like
+var jobIDPattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_-]*$`)
+
+// jobIDRule explains jobIDPattern in the problems
+const jobIDRule = "it has to start with a letter or _, and only contain letters, digits, - or _"
+
+// Position is where something is in a config
+type Position struct {
+	// Path is the path or the url of the config
+	Path string
+	// Line and Column start from 1
+	Line   int
+	Column int
+}
+
+func (p Position) String() string {
+	return fmt.Sprintf("%s:%d:%d", p.Path, p.Line, p.Column)
+}
+
+// Problem is something wrong in a config at a position
+type Problem struct {
+	Position
+	// Message describes the problem
+	Message string
+}
+
+func (p Problem) String() string {
+	return fmt.Sprintf("%s: %s", p.Position, p.Message)
+}
+
+// ValidationError reports every problem that was found in a config
+type ValidationError struct {
+	// Problems are sorted by their positions
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	lines := []string{fmt.Sprintf("%d problem(s) found in the config", len(e.Problems))}
+	for _, problem := range e.Problems {
+		lines = append(lines, "  "+problem.String())
+	}
+	return strings.Join(lines, "\n")
+}
+
+// configValidator collects the problems of the config at path
+type configValidator struct {
+	path     string
+	problems []Problem
+}
+
+func (v *configValidator) add(node *yaml.Node, format string, args ...interface{}) {
+	v.problems = append(v.problems, Problem{
+		Position: v.position(node),
+		Message:  fmt.Sprintf(format, args...),
+	})
+}
+
+func (v *configValidator) position(node *yaml.Node) Position {
+	return Position{Path: v.path, Line: node.Line, Column: node.Column}
+}
+
+// err returns a *ValidationError with the problems sorted by their positions, or nil
+// when there's no problem
+func (v *configValidator) err() error {
+	if len(v.problems) == 0 {
+		return nil
+	}
+
+	sort.SliceStable(v.problems, func(i, j int) bool {
+		a, b := v.problems[i], v.problems[j]
+		if a.Line != b.Line {
+			return a.Line < b.Line
+		}
+		return a.Column < b.Column
+	})
+	return &ValidationError{Problems: v.problems}
+}
+
+// decodeConfig strictly decodes the config at path from r. Unknown keys, values
+// with wrong types, and invalid jobs are reported together as a *ValidationError.
+func decodeConfig(path string, r io.Reader) (Config, error) {
+	var cfg Config
+	var root yaml.Node
+	if err := yaml.NewDecoder(r).Decode(&root); err != nil {
+		return cfg, err
+	}
+
+	v := configValidator{path: path}
+	v.checkNode(&root, reflect.TypeOf(cfg))
+
+	// Decoding goes on after a value with a wrong type, which has been reported
+	// already, so that the rest of the config can still be checked
+	var typeErr *yaml.TypeError
+	if err := root.Decode(&cfg); err != nil && !errors.As(err, &typeErr) {
+		return cfg, err
+	}
+
+	v.checkJobs(&root)
+	v.checkTemplates(&root)
+	v.checkIncludes(&root)
+	v.recordPositions(&root, &cfg)
+	return cfg, v.err()
+}
+
+// recordPositions remembers where the jobs, their uses and needs, the templates, and
+// the includes of cfg are, so that they can be pointed at when they're wrong
+func (v *configValidator) recordPositions(root *yaml.Node, cfg *Config) {
+	doc := documentContent(root)
+	if include := mappingValue(doc, "include"); include != nil && include.Kind == yaml.SequenceNode {
+		for _, item := range include.Content {
+			cfg.includePositions = append(cfg.includePositions, v.position(item))
+		}
+	}
+
+	if templates := mappingValue(doc, "templates"); templates != nil {
+		for i := 0; i+1 < len(templates.Content); i += 2 {
+			name := templates.Content[i].Value
+			if t, ok := cfg.Templates[name]; ok {
+				t.position = v.position(templates.Content[i])
+				cfg.Templates[name] = t
+			}
+		}
+	}
+
+	jobs := mappingValue(doc, "jobs")
+	if jobs == nil {
+		return
+	}
+
+	for i := 0; i+1 < len(jobs.Content); i += 2 {
+		id := jobs.Content[i].Value
+		job, ok := cfg.Jobs[id]
+		if !ok {
+			continue
+		}
+
+		job.position = v.position(jobs.Content[i])
+		job.usesPosition = job.position
+		if uses := mappingValue(jobs.Content[i+1], "uses"); uses != nil {
+			job.usesPosition = v.position(uses)
+		}
+		job.needsPositions = nil
+		if needs := mappingValue(jobs.Content[i+1], "needs"); needs != nil {
+			for _, need := range needs.Content {
+				job.needsPositions = append(job.needsPositions, v.position(need))
+			}
+		}
+		cfg.Jobs[id] = job
+	}
+}
+
+// checkNode reports the keys of node that t doesn't have, and the values that
+// can't be decoded into t
+func (v *configValidator) checkNode(node *yaml.Node, t reflect.Type) {
+	switch node.Kind {
+	case yaml.DocumentNode:
+		for _, child := range node.Content {
+			v.checkNode(child, t)
+		}
+		return
+	case yaml.AliasNode:
+		v.checkNode(node.Alias, t)
+		return
+	}
+
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		v.checkMapping(node, t)
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		v.checkDuplicateKeys(node)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			v.checkNode(node.Content[i+1], t.Elem())
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			v.checkNode(item, t.Elem())
+		}
+	default:
+		if err := node.Decode(reflect.New(t).Interface()); err != nil {
+			v.add(node, "%s", decodeErrorMessage(err))
+		}
+	}
+}
+
+// checkMapping checks every key of node against the fields of struct t
+func (v *configValidator) checkMapping(node *yaml.Node, t reflect.Type) {
+	fields := make(map[string]reflect.Type)
+	var inline reflect.Type
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag := strings.Split(field.Tag.Get("yaml"), ",")
+		if len(tag) > 1 && tag[1] == "inline" {
+			inline = field.Type
+			continue
+		}
+
+		if tag[0] != "" && tag[0] != "-" {
+			fields[tag[0]] = field.Type
+		}
+	}
+
+	v.checkDuplicateKeys(node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		fieldType, ok := fields[key.Value]
+		if !ok && inline != nil {
+			fieldType, ok = inline.Elem(), true
+		}
+
+		if !ok {
+			v.add(key, "unknown key %s%s", key.Value, suggestKey(key.Value, fields))
+			continue
+		}
+		v.checkNode(value, fieldType)
+	}
+}
+
+// checkDuplicateKeys reports the keys of the mapping node that are defined more than once
+func (v *configValidator) checkDuplicateKeys(node *yaml.Node) {
+	seen := make(map[string]*yaml.Node)
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key := node.Content[i]
+		if first, ok := seen[key.Value]; ok {
+			v.add(key, "duplicate key %s, it's already defined at line %d", key.Value, first.Line)
+			continue
+		}
+		seen[key.Value] = key
+	}
+}
+
+// suggestKey returns a hint with the known key that's closest to key, or an empty
+// string when none of them is close enough to be a typo
+func suggestKey(key string, fields map[string]reflect.Type) string {
+	best, bestDistance := "", 3
+	for field := range fields {
+		d := editDistance(key, field)
+		if d < bestDistance || (d == bestDistance && field < best) {
+			best, bestDistance = field, d
+		}
+	}
+
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(", did you mean %s?", best)
+}
+
+// editDistance returns the Levenshtein distance between a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// decodeErrorMessage strips the line prefix from the error of decoding a single node,
+// since the position is reported separately
+func decodeErrorMessage(err error) string {
+	var typeErr *yaml.TypeError
+	if !errors.As(err, &typeErr) || len(typeErr.Errors) == 0 {
+		return err.Error()
+	}
+
+	message := typeErr.Errors[0]
+	if strings.HasPrefix(message, "line ") {
+		if i := strings.Index(message, ": "); i >= 0 {
+			message = message[i+2:]
+		}
+	}
+	return message
+}
+
+// mappingValue returns the value of key in the mapping node, or nil when there's none
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// decodeLoosely decodes node into out. The values with wrong types have been
+// reported already, and are left empty.
+func decodeLoosely(node *yaml.Node, out interface{}) {
+	node.Decode(out)
+}
+
+// documentContent returns the top-level node of the document root
+func documentContent(root *yaml.Node) *yaml.Node {
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		return root.Content[0]
+	}
+	return root
+}
+
+// checkIncludes reports the includes without a path, and the namespaces that can't
+// be a part of job IDs
+func (v *configValidator) checkIncludes(root *yaml.Node) {
+	include := mappingValue(documentContent(root), "include")
+	if include == nil || include.Kind != yaml.SequenceNode {
+		return
+	}
+
+	for _, item := range include.Content {
+		var inc Include
+		decodeLoosely(item, &inc)
+		if inc.Path == "" && (item.Kind == yaml.ScalarNode || item.Kind == yaml.MappingNode) {
+			v.add(item, "include doesn't have a path")
+		}
+
+		if inc.Namespace != "" && !jobIDPattern.MatchString(inc.Namespace) {
+			v.add(item, "invalid namespace %q, %s", inc.Namespace, jobIDRule)
+		}
+	}
+}
+
+// checkTemplates reports the invalid template names, the steps without a command,
+// and the invalid parameters and expressions
+func (v *configValidator) checkTemplates(root *yaml.Node) {
+	templates := mappingValue(documentContent(root), "templates")
+	if templates == nil || templates.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(templates.Content); i += 2 {
+		key, templateNode := templates.Content[i], templates.Content[i+1]
+		name := key.Value
+		if !jobIDPattern.MatchString(name) {
+			v.add(key, "invalid template name %q, %s", name, jobIDRule)
+		}
+
+		var t Template
+		decodeLoosely(templateNode, &t)
+		if err := validateTemplate(name, t); err != nil {
+			v.add(key, "%v", err)
+		}
+
+		if steps := mappingValue(templateNode, "steps"); steps != nil {
+			for j, stepNode := range steps.Content {
+				run := mappingValue(stepNode, "run")
+				if stepNode.Kind == yaml.MappingNode && (run == nil || strings.TrimSpace(run.Value) == "") {
+					var step Step
+					decodeLoosely(stepNode, &step)
+					v.add(stepNode, "step %s of %s template doesn't have anything to run", stepLabel(j, step), name)
+				}
+			}
+		}
+	}
+}
+
+// checkJobs reports the invalid job IDs, the needs that refer to the job itself,
+// the steps without a command, the invalid expressions and services, and the
+// invalid uses of templates. The needs of jobs that don't exist are reported once
+// the includes have been loaded.
+func (v *configValidator) checkJobs(root *yaml.Node) {
+	jobs := mappingValue(documentContent(root), "jobs")
+	if jobs == nil || jobs.Kind != yaml.MappingNode {
+		return
+	}
+
+	for i := 0; i+1 < len(jobs.Content); i += 2 {
+		key, jobNode := jobs.Content[i], jobs.Content[i+1]
+		id := key.Value
+		if !jobIDPattern.MatchString(id) {
+			v.add(key, "invalid job ID %q, %s", id, jobIDRule)
+		}
+
+		var job Job
+		decodeLoosely(jobNode, &job)
+		if err := validateExpressions(id, job); err != nil {
+			v.add(key, "%v", err)
+		}
+
+		// A service that uses a template gets its steps once the template is expanded
+		if job.Uses == "" {
+			if err := validateService(id, job); err != nil {
+				v.add(key, "%v", err)
+			}
+
+			if with := mappingValue(jobNode, "with"); with != nil {
+				v.add(with, "%s job passes with, but it doesn't use a template", id)
+			}
+		} else if steps := mappingValue(jobNode, "steps"); steps != nil {
+			v.add(steps, "%s job uses a template, so it can't have steps", id)
+		}
+
+		if needs := mappingValue(jobNode, "needs"); needs != nil {
+			for _, need := range needs.Content {
+				if need.Value == id {
+					v.add(need, "%s job needs itself", id)
+				}
+			}
+		}
+
+		if steps := mappingValue(jobNode, "steps"); steps != nil {
+			for j, stepNode := range steps.Content {
+				run := mappingValue(stepNode, "run")
+				if stepNode.Kind == yaml.MappingNode && (run == nil || strings.TrimSpace(run.Value) == "") {
+					var step Step
+					decodeLoosely(stepNode, &step)
+					v.add(stepNode, "step %s of %s job doesn't have anything to run", stepLabel(j, step), id)
+				}
+			}
+		}
+	}
+}
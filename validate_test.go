@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfigReportsEveryProblem(t *testing.T) {
+	configRaw := `jobs:
+  build:
+    stpes:
+      - run: make
+  test:
+    need: [build]
+    needs: [buld, test]
+    timeout: soon
+    steps:
+      - name: unit
+        run: ""
+  "bad id":
+    steps:
+      - run: echo
+  build:
+    steps:
+      - run: make`
+
+	_, err := decodeConfig("ci.yaml", strings.NewReader(configRaw))
+	var validationErr *ValidationError
+	if !errors.As(err, &validationErr) {
+		t.Fatalf("expected to get a *ValidationError, but got %v", err)
+	}
+
+	expected := []string{
+		"ci.yaml:3:5: unknown key stpes, did you mean steps?",
+		"ci.yaml:6:5: unknown key need, did you mean needs?",
+		"ci.yaml:7:19: test job needs itself",
+		"ci.yaml:8:14: cannot unmarshal !!str `soon` into time.Duration",
+		`ci.yaml:10:9: step "unit" of test job doesn't have anything to run`,
+		`ci.yaml:12:3: invalid job ID "bad id", it has to start with a letter or _, and only contain letters, digits, - or _`,
+		"ci.yaml:15:3: duplicate key build, it's already defined at line 2",
+	}
+
+	var actual []string
+	for _, problem := range validationErr.Problems {
+		actual = append(actual, problem.String())
+	}
+
+	if strings.Join(actual, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("expected the problems to be\n%s\nbut got\n%s", strings.Join(expected, "\n"), strings.Join(actual, "\n"))
+	}
+
+	if !strings.HasPrefix(err.Error(), "7 problem(s) found in the config\n  ci.yaml:3:5: ") {
+		t.Fatalf("expected the error to list the problems, but got \"%v\"", err)
+	}
+}
+
+func TestDecodeConfigValid(t *testing.T) {
+	configRaw := `
+version: 1
+jobs:
+  build:
+    strategy:
+      matrix:
+        go: [1.20, 1.21]
+        include:
+          - go: 1.22
+    steps:
+      - run: make
+        retry:
+          attempts: 2
+  test:
+    needs: [build]
+    timeout: 5m
+    steps:
+      - run: make test`
+
+	cfg, err := decodeConfig("ci.yaml", strings.NewReader(configRaw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Jobs) != 2 || cfg.Jobs["build"].Strategy.Matrix.Values["go"][1] != "1.21" {
+		t.Fatalf("expected the config to be decoded, but got %+v", cfg)
+	}
+}
+
+func TestEditDistance(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected int
+	}{
+		{"", "", 0},
+		{"needs", "needs", 0},
+		{"need", "needs", 1},
+		{"stpes", "steps", 2},
+		{"run", "", 3},
+	}
+
+	for _, test := range tests {
+		if actual := editDistance(test.a, test.b); actual != test.expected {
+			t.Fatalf("expected the distance between %s and %s to be %d, but got %d", test.a, test.b, test.expected, actual)
+		}
+	}
+}
+
+func TestDecodeConfigReportsTemplateProblems(t *testing.T) {
+	configRaw := `templates:
+  build:
+    params:
+      dir:
+        type: path
+    steps:
+      - name: make
+  "bad name":
+    steps:
+      - run: make -C ${{ params.dir }}
+jobs:
+  api:
+    uses: build
+    steps:
+      - run: make
+  web:
+    with:
+      dir: web
+    steps:
+      - run: make`
+
+	_, err := decodeConfig("ci.yaml", strings.NewReader(configRaw))
+	expected := []string{
+		"ci.yaml:2:3: dir param of build template has an unknown type path, it has to be string, number, or boolean",
+		`ci.yaml:7:9: step "make" of build template doesn't have anything to run`,
+		`ci.yaml:8:3: invalid template name "bad name", it has to start with a letter or _, and only contain letters, digits, - or _`,
+		"ci.yaml:8:3: bad name template has an invalid expression: it doesn't have dir param",
+		"ci.yaml:15:7: api job uses a template, so it can't have steps",
+		"ci.yaml:18:7: web job passes with, but it doesn't use a template",
+	}
+	expectProblems(t, err, expected...)
+}
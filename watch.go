@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultDebounce is how long the files have to stay unchanged before the
+// affected jobs are run again
+const defaultDebounce = time.Millisecond * 200
+
+// watcher reports the files that changed
+type watcher interface {
+	// Events receives the path of every file that was created, written, removed, or renamed
+	Events() <-chan string
+	// Errors receives the error that stopped the watcher
+	Errors() <-chan error
+	// Close stops watching
+	Close() error
+}
+
+// watchPatterns returns the inputs and cache paths of every job in graph. These are
+// the files that affect the jobs.
+func watchPatterns(graph *Node) []string {
+	seen := make(map[string]struct{})
+	var patterns []string
+	for _, n := range graph.Descendants() {
+		for _, pattern := range append(n.Job.Inputs, n.Job.Cache.Paths...) {
+			if _, ok := seen[pattern]; !ok {
+				seen[pattern] = struct{}{}
+				patterns = append(patterns, pattern)
+			}
+		}
+	}
+	sort.Strings(patterns)
+	return patterns
+}
+
+// affectedJobs returns the IDs of the jobs that are affected by a change to paths,
+// and the IDs of their transitive dependents in sorted order. A job is affected when
+// one of its inputs matches, or one of its cache paths matches while it isn't in
+// running, since a running job writes its own cache paths.
+func affectedJobs(graph *Node, paths []string, running map[string]struct{}) []string {
+	affected := make(map[*Node]struct{})
+	for _, n := range graph.Descendants() {
+		if _, ok := affected[n]; ok {
+			continue
+		}
+
+		_, isRunning := running[n.ID]
+		if !matchAnyGlob(n.Job.Inputs, paths) && (isRunning || !matchAnyGlob(n.Job.Cache.Paths, paths)) {
+			continue
+		}
+
+		affected[n] = struct{}{}
+		for _, dependent := range n.Descendants() {
+			affected[dependent] = struct{}{}
+		}
+	}
+
+	var ids []string
+	for _, n := range sortedNodes(affected) {
+		ids = append(ids, n.ID)
+	}
+	return ids
+}
+
+func matchAnyGlob(patterns, paths []string) bool {
+	for _, pattern := range patterns {
+		for _, p := range paths {
+			if matchGlob(pattern, p) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// startWatchRun runs jobs ids from cfg in the background, and sends the result to done.
+// The returned function cancels the run.
+func startWatchRun(ctx context.Context, cfg Config, opts RunOptions, ids []string, done chan<- error) context.CancelFunc {
+	ctx, cancel := context.WithCancel(ctx)
+	opts.Context = ctx
+	opts.Jobs = ids
+	go func() {
+		done <- RunWithOptions(cfg, opts)
+	}()
+	return cancel
+}
+
+// watch runs every job in cfg, and then runs the affected jobs again whenever w
+// reports a change. The changes are collected until nothing has changed for debounce.
+// The jobs that succeeded and weren't affected by a change aren't run again, and their
+// outputs are reused. When a change affects the jobs of the in-flight run that have
+// already started, only those jobs are cancelled, and they run again with their
+// dependents once the run is done. The affected jobs that haven't started yet are left
+// to the run. The jobs that didn't succeed in a run are run again by the next change.
+// watch returns when opts.Context is done, or w fails.
+func watch(cfg Config, opts RunOptions, w watcher, debounce time.Duration) error {
+	graph, err := NewGraph(cfg)
+	if err != nil {
+		return err
+	}
+
+	nodes := make(map[string]*Node)
+	for _, n := range graph.Descendants() {
+		nodes[n.ID] = n
+	}
+
+	ctx := opts.Context
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	var (
+		startedMu sync.Mutex
+		// started maps the IDs of the jobs that have been started by the in-flight
+		// run to the functions that cancel them
+		started map[string]context.CancelFunc
+	)
+	opts.State = &RunState{Completed: make(map[string]map[string]string)}
+	opts.startJob = func(ctx context.Context, id string) context.Context {
+		ctx, cancel := context.WithCancel(ctx)
+		startedMu.Lock()
+		started[id] = cancel
+		startedMu.Unlock()
+		return ctx
+	}
+
+	var (
+		// pending are the IDs of the jobs for the next run
+		pending = make(map[string]struct{})
+		// stale are the IDs of the jobs that have to run again even if they succeeded
+		stale = make(map[string]struct{})
+		// changed are the paths that changed since the last run was started
+		changed = make(map[string]struct{})
+		// affected are the IDs of the jobs that are affected by the unsettled changes
+		affected = make(map[string]struct{})
+		// running are the IDs of the jobs in the in-flight run, or nil when nothing runs
+		running   map[string]struct{}
+		cancelRun context.CancelFunc
+		// rerun is true when pending has to run as soon as nothing runs. The jobs
+		// that didn't succeed wait in pending until a change triggers the next run.
+		rerun     = true
+		cancelled bool
+		done      = make(chan error, 1)
+		settled   <-chan time.Time
+		timer     *time.Timer
+	)
+
+	for id := range nodes {
+		pending[id] = struct{}{}
+	}
+
+	stop := func() {
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if running != nil {
+			cancelRun()
+			<-done
+		}
+	}
+
+	for {
+		if running == nil && rerun && len(pending) > 0 {
+			if len(changed) > 0 {
+				fmt.Fprintf(opts.Stdout, "changed: %s\n", strings.Join(sortedKeys(changed), ", "))
+				changed = make(map[string]struct{})
+			}
+
+			if err := opts.State.forget(sortedKeys(stale)); err != nil {
+				return err
+			}
+
+			ids := sortedKeys(pending)
+			fmt.Fprintf(opts.Stdout, "running: %s\n", strings.Join(ids, ", "))
+
+			startedMu.Lock()
+			started = make(map[string]context.CancelFunc)
+			startedMu.Unlock()
+			cancelRun = startWatchRun(ctx, cfg, opts, ids, done)
+			running, pending, stale, rerun, cancelled = pending, make(map[string]struct{}), make(map[string]struct{}), false, false
+		}
+
+		select {
+		case <-ctx.Done():
+			stop()
+			return nil
+		case err := <-w.Errors():
+			stop()
+			return err
+		case p := <-w.Events():
+			ids := affectedJobs(graph, []string{p}, running)
+			if len(ids) == 0 {
+				continue
+			}
+
+			changed[p] = struct{}{}
+			for _, id := range ids {
+				affected[id] = struct{}{}
+			}
+
+			if timer != nil {
+				timer.Stop()
+			}
+			timer = time.NewTimer(debounce)
+			settled = timer.C
+		case <-settled:
+			settled = nil
+			ids := sortedKeys(affected)
+			affected = make(map[string]struct{})
+
+			// again are the affected jobs that have to run again, and their dependents
+			again := make(map[string]struct{})
+			startedMu.Lock()
+			for _, id := range ids {
+				if _, ok := running[id]; !ok {
+					again[id] = struct{}{}
+					continue
+				}
+
+				// The jobs that have started, or finished, missed the change, while
+				// the jobs that haven't started yet will see it once they start
+				cancelJob, ok := started[id]
+				if _, completed := opts.State.isCompleted(id); !ok && !completed {
+					stale[id] = struct{}{}
+					continue
+				}
+
+				if cancelJob != nil {
+					cancelJob()
+					cancelled = true
+				}
+
+				again[id] = struct{}{}
+				for _, dependent := range nodes[id].Descendants() {
+					again[dependent.ID] = struct{}{}
+				}
+			}
+			startedMu.Unlock()
+
+			for id := range again {
+				pending[id] = struct{}{}
+				stale[id] = struct{}{}
+				rerun = true
+			}
+		case err := <-done:
+			cancelRun()
+			// The jobs that didn't succeed, e.g. because the run failed, or because
+			// they were cancelled, run again with the next run
+			for id := range running {
+				if _, ok := opts.State.isCompleted(id); !ok {
+					pending[id] = struct{}{}
+				}
+			}
+			running = nil
+
+			if err != nil {
+				fmt.Fprintln(opts.Stdout, err)
+			} else if cancelled {
+				fmt.Fprintln(opts.Stdout, "cancelled: the affected jobs will run again")
+			} else if !rerun {
+				fmt.Fprintln(opts.Stdout, "succeeded: waiting for changes")
+			} else {
+				fmt.Fprintln(opts.Stdout, "succeeded: the affected jobs will run again")
+			}
+		}
+	}
+}
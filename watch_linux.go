@@ -0,0 +1,220 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+const inotifyMask = syscall.IN_CLOSE_WRITE | syscall.IN_CREATE | syscall.IN_DELETE |
+	syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyWatcher watches the directories that can contain the files matched by
+// a list of globs with inotify
+type inotifyWatcher struct {
+	fd       int
+	file     *os.File
+	patterns []string
+	// dirs maps the watch descriptors to their directories
+	dirs map[int]string
+	// recursive has the watch descriptors whose new subdirectories are watched too
+	recursive map[int]bool
+	events    chan string
+	errors    chan error
+	closed    chan struct{}
+}
+
+// newWatcher watches every file that matches one of patterns, including the
+// files that get created later
+func newWatcher(patterns []string) (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize inotify: %w", err)
+	}
+
+	w := &inotifyWatcher{
+		fd: fd,
+		// The file is non-blocking, so reading it doesn't block a thread and
+		// closing it interrupts the read
+		file:      os.NewFile(uintptr(fd), "inotify"),
+		patterns:  patterns,
+		dirs:      make(map[int]string),
+		recursive: make(map[int]bool),
+		events:    make(chan string),
+		errors:    make(chan error, 1),
+		closed:    make(chan struct{}),
+	}
+
+	if err := w.addPatterns(); err != nil {
+		w.file.Close()
+		return nil, err
+	}
+
+	go w.read()
+	return w, nil
+}
+
+func (w *inotifyWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *inotifyWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *inotifyWatcher) Close() error {
+	close(w.closed)
+	return w.file.Close()
+}
+
+// addPatterns watches the base directory of every pattern. When a pattern has a
+// glob, or its base is a directory, the subdirectories are watched too. When the
+// base doesn't exist yet, its closest existing parent is watched, so that the
+// base can be watched once it's created.
+func (w *inotifyWatcher) addPatterns() error {
+	for _, pattern := range w.patterns {
+		base, segments, err := splitGlob(pattern)
+		if err != nil {
+			return err
+		}
+
+		hasGlob := filepath.FromSlash(strings.Join(segments, "/")) != base
+		info, err := os.Stat(base)
+		for os.IsNotExist(err) && filepath.Dir(base) != base {
+			base = filepath.Dir(base)
+			info, err = os.Stat(base)
+			hasGlob = false
+		}
+
+		if err != nil {
+			return err
+		}
+
+		if !info.IsDir() {
+			err = w.add(filepath.Dir(base), false)
+		} else if hasGlob || base == filepath.Clean(pattern) {
+			err = w.addTree(base, false)
+		} else {
+			err = w.add(base, false)
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) add(dir string, recursive bool) error {
+	wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyMask)
+	if err != nil {
+		return fmt.Errorf("failed to watch %s: %w", dir, err)
+	}
+
+	w.dirs[wd] = dir
+	w.recursive[wd] = w.recursive[wd] || recursive
+	return nil
+}
+
+// addTree watches root and every directory in it. When emit is set, the files
+// that are found are reported, since they may have been created before root
+// was watched.
+func (w *inotifyWatcher) addTree(root string, emit bool) error {
+	return filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			// The directory may be gone already
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		if info.IsDir() {
+			return w.add(p, true)
+		}
+
+		if emit {
+			w.emit(p)
+		}
+		return nil
+	})
+}
+
+func (w *inotifyWatcher) emit(p string) {
+	select {
+	case w.events <- p:
+	case <-w.closed:
+	}
+}
+
+func (w *inotifyWatcher) fail(err error) {
+	select {
+	case <-w.closed:
+	default:
+		w.errors <- err
+	}
+}
+
+func (w *inotifyWatcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				w.fail(fmt.Errorf("failed to read inotify events: %w", err))
+			}
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameStart := offset + syscall.SizeofInotifyEvent
+			offset = nameStart + int(event.Len)
+			name := strings.TrimRight(string(buf[nameStart:offset]), "\x00")
+			if err := w.handle(int(event.Wd), event.Mask, name); err != nil {
+				w.fail(err)
+				return
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) handle(wd int, mask uint32, name string) error {
+	if mask&syscall.IN_Q_OVERFLOW != 0 {
+		return errors.New("too many files changed at once to keep watching them")
+	}
+
+	if mask&syscall.IN_IGNORED != 0 {
+		delete(w.dirs, wd)
+		delete(w.recursive, wd)
+		return nil
+	}
+
+	dir, ok := w.dirs[wd]
+	if !ok {
+		return nil
+	}
+
+	p := filepath.Join(dir, name)
+	if mask&syscall.IN_ISDIR == 0 {
+		w.emit(p)
+		return nil
+	}
+
+	if mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) == 0 {
+		return nil
+	}
+
+	if w.recursive[wd] {
+		return w.addTree(p, true)
+	}
+	// The new directory may be the base of a pattern that didn't exist
+	return w.addPatterns()
+}
@@ -0,0 +1,86 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// expectEvent waits for the event of p from w, and ignores the events of other paths
+func expectEvent(t *testing.T, w watcher, p string) {
+	timeout := time.After(time.Second * 5)
+	for {
+		select {
+		case event := <-w.Events():
+			if event == p {
+				return
+			}
+		case err := <-w.Errors():
+			t.Fatal(err)
+		case <-timeout:
+			t.Fatalf("expected to get an event of %s", p)
+		}
+	}
+}
+
+func TestInotifyWatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "src")
+	if err := os.Mkdir(src, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	w, err := newWatcher([]string{
+		filepath.Join(src, "**", "*.go"),
+		filepath.Join(dir, "later", "*.txt"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	main := filepath.Join(src, "main.go")
+	if err := ioutil.WriteFile(main, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, main)
+
+	// A new subdirectory is watched too
+	sub := filepath.Join(src, "sub")
+	if err := os.Mkdir(sub, 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	nested := filepath.Join(sub, "nested.go")
+	if err := ioutil.WriteFile(nested, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, nested)
+
+	// The base of a pattern is watched once it's created
+	later := filepath.Join(dir, "later")
+	if err := os.Mkdir(later, 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	notes := filepath.Join(later, "notes.txt")
+	if err := ioutil.WriteFile(notes, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, notes)
+
+	if err := os.Remove(main); err != nil {
+		t.Fatal(err)
+	}
+	expectEvent(t, w, main)
+}
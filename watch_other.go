@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+)
+
+// newWatcher isn't supported since it relies on inotify
+func newWatcher(patterns []string) (watcher, error) {
+	return nil, errors.New("watch is only supported on Linux")
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type fakeWatcher struct {
+	events chan string
+	errors chan error
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{events: make(chan string), errors: make(chan error, 1)}
+}
+
+func (w *fakeWatcher) Events() <-chan string {
+	return w.events
+}
+
+func (w *fakeWatcher) Errors() <-chan error {
+	return w.errors
+}
+
+func (w *fakeWatcher) Close() error {
+	return nil
+}
+
+// waitForOutput waits until s appears count times in buf
+func waitForOutput(t *testing.T, buf *syncBuffer, s string, count int) {
+	deadline := time.Now().Add(time.Second * 10)
+	for strings.Count(buf.String(), s) < count {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected \"%s\" to appear %d time(s), but got \"%s\"", s, count, buf.String())
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestWatchPatterns(t *testing.T) {
+	graph, err := NewGraph(Config{
+		Jobs: map[string]Job{
+			"build": {Inputs: []string{"src/**/*.go", "go.mod"}, Cache: Cache{Key: "build", Paths: []string{"bin"}}},
+			"test":  {Inputs: []string{"go.mod"}},
+			"lint":  {},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "bin,go.mod,src/**/*.go"
+	if actual := strings.Join(watchPatterns(graph), ","); actual != expected {
+		t.Fatalf("expected the patterns to be %s, but got %s", expected, actual)
+	}
+}
+
+func TestAffectedJobs(t *testing.T) {
+	graph, err := NewGraph(Config{
+		Jobs: map[string]Job{
+			"deps":   {Cache: Cache{Key: "deps", Paths: []string{"node_modules"}}},
+			"build":  {Needs: []string{"deps"}, Inputs: []string{"src/**/*.ts", "node_modules"}},
+			"test":   {Needs: []string{"build"}},
+			"docs":   {Inputs: []string{"docs/*.md"}},
+			"deploy": {Needs: []string{"test", "docs"}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		paths    []string
+		running  map[string]struct{}
+		expected string
+	}{
+		{[]string{"src/app/main.ts"}, nil, "build,deploy,test"},
+		{[]string{"docs/README.md"}, nil, "deploy,docs"},
+		{[]string{"docs/sub/README.md"}, nil, ""},
+		{[]string{"node_modules/react/index.js"}, nil, "build,deploy,deps,test"},
+		{[]string{"node_modules/react/index.js"}, map[string]struct{}{"deps": {}}, "build,deploy,test"},
+	}
+
+	for _, test := range tests {
+		actual := strings.Join(affectedJobs(graph, test.paths, test.running), ",")
+		if actual != test.expected {
+			t.Fatalf("expected %v to affect %s, but got %s", test.paths, test.expected, actual)
+		}
+	}
+}
+
+func TestWatch(t *testing.T) {
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {Inputs: []string{"src/*.go"}, Steps: []Step{{Run: "echo build"}}},
+			"test":  {Needs: []string{"build"}, Steps: []Step{{Run: "echo test"}}},
+			"lint":  {Inputs: []string{"docs/*"}, Steps: []Step{{Run: "echo lint"}}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var stdoutBuf syncBuffer
+	w := newFakeWatcher()
+	done := make(chan error, 1)
+	go func() {
+		done <- watch(cfg, RunOptions{Context: ctx, Stdout: &stdoutBuf, MaxWorkers: 1}, w, time.Millisecond*50)
+	}()
+
+	waitForOutput(t, &stdoutBuf, "succeeded: waiting for changes", 1)
+	w.events <- "src/main.go"
+	w.events <- "README.md"
+	waitForOutput(t, &stdoutBuf, "succeeded: waiting for changes", 2)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "running: build, lint, test\nbuild\nlint\ntest\nsucceeded: waiting for changes\n" +
+		"changed: src/main.go\nrunning: build, test\nbuild\ntest\nsucceeded: waiting for changes\n"
+	if actual := stdoutBuf.String(); actual != expected {
+		t.Fatalf("expected only the affected jobs to run again, but got \"%s\"", actual)
+	}
+}
+
+func TestWatchCancelsInFlightRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fast := filepath.Join(dir, "fast")
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {Inputs: []string{"src/*.go"}, Steps: []Step{{Run: "[ -e " + fast + " ] || sleep 10; echo build"}}},
+			"lint":  {Steps: []Step{{Run: "sleep 0.5; echo lint"}}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var stdoutBuf syncBuffer
+	w := newFakeWatcher()
+	done := make(chan error, 1)
+	go func() {
+		done <- watch(cfg, RunOptions{Context: ctx, Stdout: &stdoutBuf, GracePeriod: time.Second}, w, time.Millisecond*50)
+	}()
+
+	waitForOutput(t, &stdoutBuf, "running: build, lint", 1)
+	if err := ioutil.WriteFile(fast, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.events <- "src/main.go"
+	waitForOutput(t, &stdoutBuf, "succeeded: waiting for changes", 1)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "running: build, lint\nlint\ncancelled: the affected jobs will run again\n" +
+		"changed: src/main.go\nrunning: build\nbuild\nsucceeded: waiting for changes\n"
+	if actual := stdoutBuf.String(); actual != expected {
+		t.Fatalf("expected only the affected job to be cancelled, but got \"%s\"", actual)
+	}
+}
+
+func TestWatchLeavesQueuedJobsToInFlightRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	ready := filepath.Join(dir, "ready")
+	cfg := Config{
+		Jobs: map[string]Job{
+			"deps":  {Steps: []Step{{Run: "while [ ! -e " + ready + " ]; do sleep 0.01; done; echo deps"}}},
+			"build": {Needs: []string{"deps"}, Inputs: []string{"src/*.go"}, Steps: []Step{{Run: "echo build"}}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var stdoutBuf syncBuffer
+	w := newFakeWatcher()
+	done := make(chan error, 1)
+	go func() {
+		done <- watch(cfg, RunOptions{Context: ctx, Stdout: &stdoutBuf}, w, time.Millisecond*50)
+	}()
+
+	waitForOutput(t, &stdoutBuf, "running: build, deps", 1)
+	w.events <- "src/main.go"
+	// build hasn't started when the change settles, so it sees the change once it starts
+	time.Sleep(time.Millisecond * 200)
+	if err := ioutil.WriteFile(ready, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitForOutput(t, &stdoutBuf, "succeeded: waiting for changes", 1)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "running: build, deps\ndeps\nbuild\nsucceeded: waiting for changes\n"
+	if actual := stdoutBuf.String(); actual != expected {
+		t.Fatalf("expected the in-flight run to keep going, but got \"%s\"", actual)
+	}
+}
+
+func TestWatchRunsIncompleteJobsAgain(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gotopus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fixed := filepath.Join(dir, "fixed")
+	cfg := Config{
+		Jobs: map[string]Job{
+			"build": {Steps: []Step{{Run: "[ -e " + fixed + " ] && echo build"}}},
+			"test":  {Needs: []string{"build"}, Steps: []Step{{Run: "echo test"}}},
+			"lint":  {Inputs: []string{"docs/*"}, Steps: []Step{{Run: "echo lint"}}},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var stdoutBuf syncBuffer
+	w := newFakeWatcher()
+	done := make(chan error, 1)
+	go func() {
+		done <- watch(cfg, RunOptions{Context: ctx, Stdout: &stdoutBuf, MaxWorkers: 1, KeepGoing: true}, w, time.Millisecond*50)
+	}()
+
+	waitForOutput(t, &stdoutBuf, "test skipped: a dependency failed", 1)
+	if err := ioutil.WriteFile(fixed, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	w.events <- "docs/README.md"
+	waitForOutput(t, &stdoutBuf, "succeeded: waiting for changes", 1)
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "changed: docs/README.md\nrunning: build, lint, test\nbuild\nlint\ntest\nsucceeded: waiting for changes\n"
+	actual := stdoutBuf.String()
+	if !strings.HasSuffix(actual, expected) || strings.Count(actual, "running:") != 2 {
+		t.Fatalf("expected the jobs that didn't succeed to run with the next change, but got \"%s\"", actual)
+	}
+}
+
+func TestWatchError(t *testing.T) {
+	w := newFakeWatcher()
+	w.errors <- errors.New("boom")
+	var stdoutBuf syncBuffer
+	err := watch(Config{Jobs: map[string]Job{"build": {}}}, RunOptions{Stdout: &stdoutBuf}, w, time.Millisecond)
+	if err == nil || err.Error() != "boom" {
+		t.Fatalf("expected the error from the watcher, but got %v", err)
+	}
+}